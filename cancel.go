@@ -0,0 +1,138 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// errCancelled is the error of the commands of a cancelled chain
+var errCancelled = errors.New("cancelled")
+
+// timeoutError is the error of the commands stopped by their timeout
+type timeoutError struct {
+	timeout time.Duration
+}
+
+func (err timeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s", err.timeout)
+}
+
+// inflight tracks the chain of commands started by runCommandsIfneeded, a chain
+// with a command with cancelOnChange is cancelled when the command is matched again
+var inflight struct {
+	mx        sync.Mutex
+	commands  map[*command]bool
+	cancelled bool
+}
+
+func startInflight() {
+	inflight.mx.Lock()
+	inflight.commands = map[*command]bool{}
+	inflight.cancelled = false
+	inflight.mx.Unlock()
+}
+
+func endInflight() {
+	inflight.mx.Lock()
+	inflight.commands = nil
+	inflight.mx.Unlock()
+}
+
+// enterInflight adds cmd to the chain, it returns false when the chain was cancelled
+func enterInflight(cmd *command) bool {
+	inflight.mx.Lock()
+	defer inflight.mx.Unlock()
+	if inflight.commands != nil {
+		inflight.commands[cmd] = true
+	}
+	return !inflight.cancelled
+}
+
+// inflightCancelled reports if the running chain was cancelled
+func inflightCancelled() bool {
+	inflight.mx.Lock()
+	defer inflight.mx.Unlock()
+	return inflight.cancelled
+}
+
+// cancelInflight cancels the running chain when it contains cmd and cmd has cancelOnChange,
+// the wait commands of the chain are stopped and the commands not started yet are skipped
+func cancelInflight(cmd *command, path string) {
+	if !cmd.CancelOnChange {
+		return
+	}
+
+	inflight.mx.Lock()
+	if !inflight.commands[cmd] || inflight.cancelled {
+		inflight.mx.Unlock()
+		return
+	}
+	inflight.cancelled = true
+	chain := make([]*command, 0, len(inflight.commands))
+	for command := range inflight.commands {
+		chain = append(chain, command)
+	}
+	inflight.mx.Unlock()
+
+	trace("%s changed, cancelling the running commands of %s", path, cmd.name)
+	for _, command := range chain {
+		command.interrupt()
+	}
+}
+
+// cancelAll cancels the running chain and stops the wait commands, used when devop exits
+func cancelAll() {
+	inflight.mx.Lock()
+	inflight.cancelled = true
+	inflight.mx.Unlock()
+	for _, command := range commands {
+		command.interrupt()
+	}
+}
+
+// interrupt sends the stop signal to the wait process of the command, the process group is killed
+// when it doesn't exit in stopTimeout, the process is waited by the runner
+func (cmd *command) interrupt() {
+	cmd.mx.Lock()
+	process := cmd.waiting
+	cmd.mx.Unlock()
+	if process == nil || process.Process == nil {
+		return
+	}
+
+	if err := signalProcessGroup(process, cmd.stopSignal); err != nil {
+		debug("err sending %s to %s: %s", cmd.stopSignal, cmd.name, err)
+	}
+
+	time.AfterFunc(cmd.stopTimeout, func() {
+		cmd.mx.Lock()
+		defer cmd.mx.Unlock()
+		if cmd.waiting == process {
+			trace("command %s did not stop in %s, killing it", cmd.name, cmd.stopTimeout)
+			killProcessGroup(process)
+		}
+	})
+}
+
+// setWaiting records the process the runner is waiting for
+func (cmd *command) setWaiting(process *exec.Cmd) {
+	cmd.mx.Lock()
+	cmd.waiting = process
+	cmd.mx.Unlock()
+}
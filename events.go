@@ -0,0 +1,78 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// eventOp is a set of file system operations, the trackers translate the events
+// of the watcher in use to these operations
+type eventOp uint8
+
+const (
+	opCreate eventOp = 1 << iota
+	opWrite
+	opRemove
+	opRename
+	opChmod
+)
+
+// opDefault are the operations a command responds to when on: is not set,
+// chmod only events are produced by indexers and tools and don't trigger commands
+const opDefault = opCreate | opWrite | opRemove | opRename
+
+var eventOpNames = []struct {
+	name string
+	op   eventOp
+}{
+	{"create", opCreate},
+	{"write", opWrite},
+	{"remove", opRemove},
+	{"rename", opRename},
+	{"chmod", opChmod},
+}
+
+// parseEventOps parses the list of operation names used in the on: option of a command
+func parseEventOps(names []string) (ops eventOp, err error) {
+	if len(names) == 0 {
+		return opDefault, nil
+	}
+	for _, name := range names {
+		var found bool
+		for _, opName := range eventOpNames {
+			if strings.EqualFold(name, opName.name) {
+				ops |= opName.op
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown event %q, expected one of create, write, remove, rename or chmod", name)
+		}
+	}
+	return
+}
+
+func (op eventOp) String() string {
+	var names []string
+	for _, opName := range eventOpNames {
+		if op&opName.op == opName.op {
+			names = append(names, opName.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
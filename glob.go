@@ -0,0 +1,141 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// globToRegexp translates a glob pattern to a regular expression, * and ? don't match
+// path separators and ** matches any number of directories
+func globToRegexp(glob string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					i++
+					buf.WriteString("(.*/)?")
+				} else {
+					buf.WriteString(".*")
+				}
+			} else {
+				buf.WriteString("[^/]*")
+			}
+		case '?':
+			buf.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				buf.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				buf.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return buf.String()
+}
+
+// escapeGlob escapes the characters of path that have a meaning in a glob or an ignore rule
+func escapeGlob(path string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; c {
+		case '*', '?', '[', '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+// globMatcher matches paths relative to the first base containing them against
+// a list of globs, globs starting with ! exclude the paths they match
+type globMatcher struct {
+	bases   []string
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func newGlobMatcher(bases []string, globs []string) (*globMatcher, error) {
+	m := &globMatcher{bases: bases}
+	for _, glob := range globs {
+		exclude := strings.HasPrefix(glob, "!")
+		if exclude {
+			glob = glob[1:]
+		}
+		pattern, err := regexp.Compile("^" + globToRegexp(strings.TrimPrefix(filepath.ToSlash(glob), "/")) + "$")
+		if err != nil {
+			return nil, err
+		}
+		if exclude {
+			m.exclude = append(m.exclude, pattern)
+		} else {
+			m.include = append(m.include, pattern)
+		}
+	}
+	return m, nil
+}
+
+// match reports if path is inside one of the bases, matches one of the include globs and
+// none of the exclude globs, without include globs all paths are included
+func (m *globMatcher) match(path string) bool {
+	var rel string
+	var ok bool
+	for _, base := range m.bases {
+		if rel, ok = within(base, path); ok {
+			break
+		}
+	}
+	if !ok {
+		return false
+	}
+
+	for _, pattern := range m.exclude {
+		if pattern.MatchString(rel) {
+			return false
+		}
+	}
+
+	if len(m.include) == 0 {
+		return true
+	}
+
+	for _, pattern := range m.include {
+		if pattern.MatchString(rel) {
+			return true
+		}
+	}
+	return false
+}
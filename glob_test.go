@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestGlobMatcher(t *testing.T) {
+	m, err := newGlobMatcher([]string{filepath.FromSlash("/project"), filepath.FromSlash("/shared")}, []string{"**/*.go", "templates/*.html", "!vendor/**", "!**/*_test.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		matched bool
+	}{
+		{"/project/main.go", true},
+		{"/project/cmd/app/main.go", true},
+		{"/project/main_test.go", false},
+		{"/project/vendor/github.com/pkg/pkg.go", false},
+		{"/project/templates/index.html", true},
+		{"/project/templates/partials/nav.html", false},
+		{"/project/README.md", false},
+		{"/shared/lib.go", true},
+		{"/other/lib.go", false},
+	}
+
+	for _, test := range tests {
+		if matched := m.match(filepath.FromSlash(test.path)); matched != test.matched {
+			t.Errorf("match(%q) = %v, expected %v", test.path, matched, test.matched)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// goDeps keeps the dirs of the local packages imported by a Go package, packages of the
+// standard library and of the module cache are left out, modules replaced by local
+// dirs and the modules of the workspace are included
+type goDeps struct {
+	pkg string
+	dir string
+	env []string
+
+	mx sync.RWMutex
+	// pkgDirs are the dirs of the packages and their embed patterns
+	pkgDirs  map[string][]string
+	modDirs  []string
+	workFile string
+
+	reloadMx  sync.Mutex
+	reloading bool
+	pending   bool
+}
+
+type goListPackage struct {
+	Dir           string
+	Standard      bool
+	EmbedPatterns []string
+	Module        *struct {
+		Main    bool
+		Dir     string
+		Replace *struct {
+			Dir     string
+			Version string
+		}
+	}
+}
+
+func newGoDeps(pkg, dir string, env []string) *goDeps {
+	return &goDeps{pkg: pkg, dir: dir, env: env, pkgDirs: map[string][]string{}, modDirs: []string{dir}}
+}
+
+func (d *goDeps) goCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command("go", args...)
+	cmd.Dir = d.dir
+	cmd.Env = d.env
+	return cmd
+}
+
+// load resolves the dependencies of the package with go list
+func (d *goDeps) load() error {
+	var stderr bytes.Buffer
+	cmd := d.goCommand("list", "-e", "-deps", "-json", d.pkg)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("go list %s: %s %s", d.pkg, err, strings.TrimSpace(stderr.String()))
+	}
+
+	pkgDirs := map[string][]string{}
+	var modDirs []string
+	decoder := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var pkg goListPackage
+		if err := decoder.Decode(&pkg); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("go list %s: %s", d.pkg, err)
+		}
+
+		if pkg.Standard || pkg.Dir == "" {
+			continue
+		}
+
+		switch {
+		case pkg.Module == nil:
+			// GOPATH mode, vendored packages are not watched
+			if strings.Contains(filepath.ToSlash(pkg.Dir), "/vendor/") {
+				continue
+			}
+			modDirs = append(modDirs, pkg.Dir)
+		case pkg.Module.Main:
+			modDirs = append(modDirs, pkg.Module.Dir)
+		case pkg.Module.Replace != nil && pkg.Module.Replace.Version == "":
+			modDirs = append(modDirs, absPath(d.dir, pkg.Module.Replace.Dir))
+		default:
+			continue
+		}
+		pkgDirs[pkg.Dir] = pkg.EmbedPatterns
+	}
+
+	var workFile string
+	if out, err := d.goCommand("env", "GOWORK").Output(); err == nil {
+		if workFile = strings.TrimSpace(string(out)); workFile == "off" {
+			workFile = ""
+		}
+	}
+	if workFile != "" {
+		modDirs = append(modDirs, filepath.Dir(workFile))
+	}
+
+	d.mx.Lock()
+	d.pkgDirs = pkgDirs
+	d.modDirs = collapseDirs(modDirs)
+	d.workFile = workFile
+	d.mx.Unlock()
+	return nil
+}
+
+// dirs returns the dirs that need to be watched to track the package and it's dependencies
+func (d *goDeps) dirs() []string {
+	d.mx.RLock()
+	defer d.mx.RUnlock()
+	return append([]string{}, d.modDirs...)
+}
+
+// contains reports if path is a .go file or an embedded file of one of the
+// packages, or one of the go.mod, go.sum and go.work files of the modules
+func (d *goDeps) contains(file string) bool {
+	d.mx.RLock()
+	defer d.mx.RUnlock()
+
+	if file == d.workFile {
+		return true
+	}
+
+	switch filepath.Base(file) {
+	case "go.mod", "go.sum", "go.work":
+		return withinAny(d.modDirs, file)
+	}
+
+	if _, found := d.pkgDirs[filepath.Dir(file)]; found && strings.HasSuffix(file, ".go") {
+		return true
+	}
+
+	// the embedded files can be in subdirectories of the package
+	for dir := filepath.Dir(file); ; dir = filepath.Dir(dir) {
+		if patterns := d.pkgDirs[dir]; len(patterns) > 0 {
+			if rel, ok := within(dir, file); ok && embeds(patterns, rel) {
+				return true
+			}
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return false
+		}
+	}
+}
+
+// embeds reports if the slash separated path rel is embedded by one of the //go:embed patterns, the files
+// of an embedded dir starting with . or _ are left out, unless the pattern has the all: prefix
+func embeds(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		all := strings.HasPrefix(pattern, "all:")
+		pattern = strings.TrimPrefix(pattern, "all:")
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		for i := 0; i < len(rel); i++ {
+			if rel[i] != '/' {
+				continue
+			}
+			if ok, _ := path.Match(pattern, rel[:i]); ok && (all || !hiddenPath(rel[i+1:])) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hiddenPath reports if an element of the slash separated path starts with . or _
+func hiddenPath(rel string) bool {
+	for _, name := range strings.Split(rel, "/") {
+		if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+			return true
+		}
+	}
+	return false
+}
+
+// affectedBy reports if a modification of path can change the dependencies
+func (d *goDeps) affectedBy(path string) bool {
+	switch filepath.Base(path) {
+	case "go.mod", "go.work":
+		return d.contains(path)
+	}
+	return strings.HasSuffix(path, ".go") && d.contains(path)
+}
+
+// reload loads the dependencies in background, reloads requested while
+// loading are coalesced in a single reload, after reload onChange is called
+func (d *goDeps) reload(onChange func()) {
+	d.reloadMx.Lock()
+	defer d.reloadMx.Unlock()
+	if d.reloading {
+		d.pending = true
+		return
+	}
+	d.reloading = true
+
+	go func() {
+		for {
+			debug("reloading dependencies of go package %s", d.pkg)
+			if err := d.load(); err != nil {
+				trace("[warning] can't load the dependencies of go package %s: %s", d.pkg, err)
+			} else {
+				onChange()
+			}
+
+			d.reloadMx.Lock()
+			if !d.pending {
+				d.reloading = false
+				d.reloadMx.Unlock()
+				return
+			}
+			d.pending = false
+			d.reloadMx.Unlock()
+		}
+	}()
+}
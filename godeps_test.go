@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestGoDepsContains(t *testing.T) {
+	d := newGoDeps("./cmd/server", filepath.FromSlash("/project"), nil)
+	d.pkgDirs = map[string][]string{
+		filepath.FromSlash("/project/cmd/server"): {"static", "templates/*.html"},
+		filepath.FromSlash("/project/lib"):        nil,
+		filepath.FromSlash("/shared/assets"):      {"all:files"},
+	}
+	d.modDirs = []string{filepath.FromSlash("/project"), filepath.FromSlash("/shared")}
+
+	tests := []struct {
+		path     string
+		contains bool
+	}{
+		{"/project/cmd/server/main.go", true},
+		{"/project/cmd/server/main_test.go", true},
+		{"/project/cmd/server/server", false},
+		{"/project/cmd/server/.main.go.swp", false},
+		{"/project/cmd/server/static/app.js", true},
+		{"/project/cmd/server/static/css/app.css", true},
+		{"/project/cmd/server/static/.DS_Store", false},
+		{"/project/cmd/server/templates/index.html", true},
+		{"/project/cmd/server/templates/index.txt", false},
+		{"/project/lib/lib.go", true},
+		{"/project/lib/notes.txt", false},
+		{"/project/lib/sub/sub.go", false},
+		{"/shared/assets/files/.env", true},
+		{"/project/go.mod", true},
+		{"/project/go.sum", true},
+		{"/shared/go.mod", true},
+		{"/other/go.mod", false},
+		{"/other/main.go", false},
+	}
+
+	for _, test := range tests {
+		if contains := d.contains(filepath.FromSlash(test.path)); contains != test.contains {
+			t.Errorf("contains(%q) = %v, expected %v", test.path, contains, test.contains)
+		}
+	}
+}
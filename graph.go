@@ -0,0 +1,339 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// commandList is a list of command names, a single name is accepted in place of the list
+type commandList []string
+
+func (l *commandList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		if name != "" {
+			*l = commandList{name}
+		}
+		return nil
+	}
+
+	var names []string
+	if err := unmarshal(&names); err != nil {
+		return err
+	}
+	*l = names
+	return nil
+}
+
+// commandNames returns the names of the commands sorted
+func commandNames(commands map[string]*command) []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runCondition is the result of a command its continuation runs on
+type runCondition int
+
+const (
+	// runAlways continuations run when the command ran, continue:
+	runAlways runCondition = iota
+	// runOnSuccess continuations run when the command succeeded, onSuccess: and dependsOn:
+	runOnSuccess
+	// runOnFailure continuations run when the command failed, onFailure:
+	runOnFailure
+)
+
+// commandEdge links a command with a command that runs after it
+type commandEdge struct {
+	command *command
+	when    runCondition
+}
+
+// runStatus is the result of a command in a run of the graph
+type runStatus int
+
+const (
+	statusSucceeded runStatus = iota + 1
+	statusFailed
+	statusTimedOut
+	statusSkipped
+)
+
+// holds reports if a continuation with the condition runs after a command completed with status
+func (when runCondition) holds(status runStatus) bool {
+	switch when {
+	case runOnSuccess:
+		return status == statusSucceeded
+	case runOnFailure:
+		return status == statusFailed || status == statusTimedOut
+	}
+	return status != statusSkipped
+}
+
+// resolveGraph links the commands with their continuations and dependencies, the continuations and
+// the commands that depend on a command run after it, cycles are rejected
+func (s *Service) resolveGraph() error {
+	var unknown []string
+	link := func(from, to *command, when runCondition) {
+		for _, edge := range from.next {
+			if edge.command == to && edge.when == when {
+				return
+			}
+		}
+		from.next = append(from.next, commandEdge{command: to, when: when})
+	}
+	continuations := func(name string, option string, names commandList, when runCondition) {
+		for _, next := range names {
+			if to, found := s.Commands[next]; found {
+				link(s.Commands[name], to, when)
+			} else {
+				unknown = append(unknown, fmt.Sprintf("%q in %s of command %s", next, option, name))
+			}
+		}
+	}
+
+	for _, name := range commandNames(s.Commands) {
+		cmd := s.Commands[name]
+		cmd.name = name
+		continuations(name, "continue", cmd.Continue, runAlways)
+		continuations(name, "onSuccess", cmd.OnSuccess, runOnSuccess)
+		continuations(name, "onFailure", cmd.OnFailure, runOnFailure)
+		for _, dep := range cmd.DependsOn {
+			if from, found := s.Commands[dep]; found {
+				link(from, cmd, runOnSuccess)
+			} else {
+				unknown = append(unknown, fmt.Sprintf("%q in dependsOn of command %s", dep, name))
+			}
+		}
+	}
+
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown commands: %s", strings.Join(unknown, ", "))
+	}
+
+	if cycle := findCycle(s.Commands); cycle != nil {
+		return fmt.Errorf("commands depend on themselves: %s", strings.Join(cycle, " -> "))
+	}
+	return nil
+}
+
+// findCycle returns the names of the commands of a cycle in the graph of the commands, or nil
+func findCycle(commands map[string]*command) []string {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[*command]int{}
+	var path []*command
+	var visit func(cmd *command) []string
+	visit = func(cmd *command) []string {
+		switch state[cmd] {
+		case visited:
+			return nil
+		case visiting:
+			var cycle []string
+			for i := len(path) - 1; i >= 0; i-- {
+				if path[i] == cmd {
+					for _, c := range path[i:] {
+						cycle = append(cycle, c.name)
+					}
+					break
+				}
+			}
+			return append(cycle, cmd.name)
+		}
+		state[cmd] = visiting
+		path = append(path, cmd)
+		for _, edge := range cmd.next {
+			if cycle := visit(edge.command); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		state[cmd] = visited
+		return nil
+	}
+
+	for _, name := range commandNames(commands) {
+		if cycle := visit(commands[name]); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// commandResult is the result of the runs of a command
+type commandResult struct {
+	command *command
+	err     error
+}
+
+// commandsByName sorts the commands by name, the ready commands start in this order
+type commandsByName []*command
+
+func (l commandsByName) Len() int           { return len(l) }
+func (l commandsByName) Less(i, j int) bool { return l[i].name < l[j].name }
+func (l commandsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// runGraph runs the matched commands and the commands that continue or depend on them with runCommand, a
+// command starts when the commands of the run it depends on completed, independent commands run in parallel
+// up to limit commands at a time. Continuations run when their condition holds, matched commands are
+// skipped when a command they depend on, or continue on success, failed
+func runGraph(commandMap map[string]*commandRun, limit int, runCommand func(string, *commandRun) error) {
+	// runs are the runs of each command of the graph, continuations run with the triggers of the commands they continue
+	runs := map[*command]map[string]*commandRun{}
+	inherited := map[*command]*commandRun{}
+	matched := map[*command]bool{}
+	var queue []*command
+	for cmdString, run := range commandMap {
+		if runs[run.command] == nil {
+			runs[run.command] = map[string]*commandRun{}
+			matched[run.command] = true
+			queue = append(queue, run.command)
+		}
+		runs[run.command][cmdString] = run
+	}
+	for len(queue) > 0 {
+		cmd := queue[0]
+		queue = queue[1:]
+		for _, edge := range cmd.next {
+			if runs[edge.command] == nil {
+				runs[edge.command] = map[string]*commandRun{}
+				queue = append(queue, edge.command)
+			}
+		}
+	}
+
+	pending := map[*command]int{}
+	for cmd := range runs {
+		for _, edge := range cmd.next {
+			pending[edge.command]++
+		}
+	}
+	var ready []*command
+	for cmd := range runs {
+		if pending[cmd] == 0 {
+			ready = append(ready, cmd)
+		}
+	}
+
+	// fired are the continuations which condition held, blockedBy why a command needing others to succeed is skipped
+	fired := map[*command]bool{}
+	blockedBy := map[*command]string{}
+	complete := func(cmd *command, status runStatus) {
+		for _, edge := range cmd.next {
+			next := edge.command
+			if edge.when.holds(status) {
+				fired[next] = true
+				if !matched[next] {
+					for _, run := range runs[cmd] {
+						inherit(inherited, next, run)
+					}
+				}
+			} else if edge.when == runOnSuccess && blockedBy[next] == "" {
+				if status == statusTimedOut {
+					blockedBy[next] = cmd.name + " timed out"
+				} else {
+					blockedBy[next] = cmd.name + " did not succeed"
+				}
+			}
+			if pending[next]--; pending[next] == 0 {
+				ready = append(ready, next)
+			}
+		}
+	}
+
+	if limit < 1 {
+		limit = 1
+	}
+	done := make(chan commandResult)
+	running := 0
+	for len(ready) > 0 || running > 0 {
+		sort.Sort(commandsByName(ready))
+		for len(ready) > 0 && running < limit {
+			cmd := ready[0]
+			ready = ready[1:]
+
+			if blockedBy[cmd] != "" {
+				if matched[cmd] || fired[cmd] {
+					trace("skipping command %s, %s", cmd.name, blockedBy[cmd])
+				} else if len(cmd.runningCommands()) > 0 {
+					trace("keeping command %s running, %s", cmd.name, blockedBy[cmd])
+				}
+				complete(cmd, statusSkipped)
+				continue
+			}
+			if !matched[cmd] && !fired[cmd] {
+				debug("skipping command %s, no continuation condition held", cmd.name)
+				complete(cmd, statusSkipped)
+				continue
+			}
+
+			if !matched[cmd] {
+				run := inherited[cmd]
+				if run == nil {
+					run = &commandRun{command: cmd}
+				}
+				runs[cmd][cmd.Command] = run
+			}
+			running++
+			go func(cmd *command, cmdRuns map[string]*commandRun) {
+				var err error
+				for cmdString, run := range cmdRuns {
+					if runErr := runCommand(cmdString, run); runErr != nil {
+						err = runErr
+					}
+				}
+				done <- commandResult{command: cmd, err: err}
+			}(cmd, runs[cmd])
+		}
+		if running == 0 {
+			continue
+		}
+
+		result := <-done
+		running--
+		if inflightCancelled() {
+			ready = nil
+			continue
+		}
+		switch result.err.(type) {
+		case nil:
+			complete(result.command, statusSucceeded)
+		case timeoutError:
+			complete(result.command, statusTimedOut)
+		default:
+			complete(result.command, statusFailed)
+		}
+	}
+}
+
+// inherit adds the triggers of run to the run of the continuation next
+func inherit(inherited map[*command]*commandRun, next *command, run *commandRun) {
+	continuation, found := inherited[next]
+	if !found {
+		inherited[next] = &commandRun{command: next, triggers: append([]*trigger(nil), run.triggers...)}
+		return
+	}
+	for _, t := range run.triggers {
+		continuation.addTrigger(t)
+	}
+}
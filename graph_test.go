@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testGraph returns a service with the graph of the commands resolved
+func testGraph(t *testing.T, commands map[string]*command) *Service {
+	s := &Service{Commands: commands}
+	if err := s.resolveGraph(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestFindCycle(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands map[string]*command
+		cycle    []string
+	}{
+		{"chain", map[string]*command{
+			"build": {Continue: commandList{"run"}},
+			"run":   {},
+		}, nil},
+		{"diamond", map[string]*command{
+			"build":  {OnSuccess: commandList{"test", "lint"}},
+			"test":   {},
+			"lint":   {},
+			"deploy": {DependsOn: commandList{"test", "lint"}},
+		}, nil},
+		{"self", map[string]*command{
+			"build": {Continue: commandList{"build"}},
+		}, []string{"build", "build"}},
+		{"loop", map[string]*command{
+			"a": {Continue: commandList{"b"}},
+			"b": {OnFailure: commandList{"c"}},
+			"c": {OnSuccess: commandList{"a"}},
+		}, []string{"a", "b", "c", "a"}},
+		{"depends", map[string]*command{
+			"a": {DependsOn: commandList{"b"}},
+			"b": {DependsOn: commandList{"a"}},
+		}, []string{"a", "b", "a"}},
+	}
+
+	for _, test := range tests {
+		s := &Service{Commands: test.commands}
+		err := s.resolveGraph()
+		if cycle := findCycle(test.commands); !reflect.DeepEqual(cycle, test.cycle) {
+			t.Errorf("%s: findCycle = %v, expected %v", test.name, cycle, test.cycle)
+		}
+		if (err != nil) != (test.cycle != nil) {
+			t.Errorf("%s: resolveGraph = %v", test.name, err)
+		}
+	}
+}
+
+// graphRunner runs the commands of a graph in the tests, the commands fail with the errors of results
+type graphRunner struct {
+	mx       sync.Mutex
+	results  map[string]error
+	started  map[string]int
+	finished map[string]int
+	events   int
+	running  int
+	max      int
+}
+
+func newGraphRunner(results map[string]error) *graphRunner {
+	return &graphRunner{results: results, started: map[string]int{}, finished: map[string]int{}}
+}
+
+func (r *graphRunner) run(cmdString string, run *commandRun) error {
+	r.mx.Lock()
+	r.events++
+	r.started[run.name] = r.events
+	if r.running++; r.running > r.max {
+		r.max = r.running
+	}
+	r.mx.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.events++
+	r.finished[run.name] = r.events
+	r.running--
+	return r.results[run.name]
+}
+
+func (r *graphRunner) ran(name string) bool {
+	return r.started[name] != 0
+}
+
+func matchedRuns(s *Service, names ...string) map[string]*commandRun {
+	runs := map[string]*commandRun{}
+	for _, name := range names {
+		runs[name] = &commandRun{command: s.Commands[name]}
+	}
+	return runs
+}
+
+func TestRunGraphOrder(t *testing.T) {
+	s := testGraph(t, map[string]*command{
+		"build":  {OnSuccess: commandList{"test", "lint"}},
+		"test":   {},
+		"lint":   {},
+		"deploy": {DependsOn: commandList{"test", "lint"}},
+	})
+	r := newGraphRunner(nil)
+	runGraph(matchedRuns(s, "build", "deploy"), 4, r.run)
+
+	for _, name := range []string{"test", "lint"} {
+		if !r.ran(name) || r.started[name] < r.finished["build"] {
+			t.Errorf("%s started before build finished", name)
+		}
+		if !r.ran("deploy") || r.started["deploy"] < r.finished[name] {
+			t.Errorf("deploy started before %s finished", name)
+		}
+	}
+	if r.max != 2 {
+		t.Errorf("test and lint did not run in parallel, max running %d", r.max)
+	}
+}
+
+func TestRunGraphLimit(t *testing.T) {
+	s := testGraph(t, map[string]*command{
+		"a": {}, "b": {}, "c": {}, "d": {}, "e": {},
+	})
+	r := newGraphRunner(nil)
+	runGraph(matchedRuns(s, "a", "b", "c", "d", "e"), 2, r.run)
+	if len(r.started) != 5 {
+		t.Errorf("ran %d commands, expected 5", len(r.started))
+	}
+	if r.max != 2 {
+		t.Errorf("max running %d, expected 2", r.max)
+	}
+
+	r = newGraphRunner(nil)
+	runGraph(matchedRuns(s, "a", "b", "c"), 0, r.run)
+	if len(r.started) != 3 || r.max != 1 {
+		t.Errorf("ran %d commands, max running %d, expected 3 commands one at a time", len(r.started), r.max)
+	}
+}
+
+func TestRunGraphConditions(t *testing.T) {
+	graph := func() *Service {
+		return testGraph(t, map[string]*command{
+			"build":   {Continue: commandList{"clean"}, OnSuccess: commandList{"app"}, OnFailure: commandList{"notify"}},
+			"clean":   {},
+			"app":     {Continue: commandList{"browser"}},
+			"browser": {},
+			"notify":  {},
+			"test":    {DependsOn: commandList{"build"}},
+		})
+	}
+
+	tests := []struct {
+		name   string
+		err    error
+		ran    []string
+		notRan []string
+	}{
+		{"success", nil, []string{"build", "clean", "app", "browser", "test"}, []string{"notify"}},
+		{"failure", errors.New("exit status 1"), []string{"build", "clean", "notify"}, []string{"app", "browser", "test"}},
+		{"timeout", timeoutError{time.Second}, []string{"build", "clean", "notify"}, []string{"app", "browser", "test"}},
+	}
+
+	for _, test := range tests {
+		s := graph()
+		r := newGraphRunner(map[string]error{"build": test.err})
+		runGraph(matchedRuns(s, "build", "test"), 4, r.run)
+		for _, name := range test.ran {
+			if !r.ran(name) {
+				t.Errorf("%s: %s did not run", test.name, name)
+			}
+		}
+		for _, name := range test.notRan {
+			if r.ran(name) {
+				t.Errorf("%s: %s ran", test.name, name)
+			}
+		}
+	}
+}
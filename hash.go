@@ -0,0 +1,96 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha1"
+	"io"
+	"os"
+	"sync"
+)
+
+// contentHashes keeps the hash of the files that triggered each command when it last ran, when
+// the debounce window of a run closes the triggers of the files with the same content are
+// dropped, ex: files saved without changes, touched or checked out with the same content
+var contentHashes = hashCache{hashes: map[hashKey][sha1.Size]byte{}}
+
+type hashKey struct {
+	command string
+	path    string
+}
+
+type hashCache struct {
+	mx     sync.Mutex
+	hashes map[hashKey][sha1.Size]byte
+}
+
+// fileSum is the hash of a file computed once while the runs are checked
+type fileSum struct {
+	sum [sha1.Size]byte
+	err error
+}
+
+func hashFile(path string) (sum [sha1.Size]byte, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return
+	}
+	copy(sum[:], h.Sum(nil))
+	return
+}
+
+// changedTriggers returns the triggers of run which files changed since the last run of the
+// command and stores their current hash, files that can't be read are always changed and the
+// hash of a file is forgotten only when it's still missing, sums holds the hashes computed
+func (c *hashCache) changedTriggers(run *commandRun, sums map[string]fileSum) []*trigger {
+	var changed []*trigger
+	for _, t := range run.triggers {
+		fs, found := sums[t.File]
+		if !found {
+			fs.sum, fs.err = hashFile(t.File)
+			sums[t.File] = fs
+		}
+
+		key := hashKey{command: run.name, path: t.File}
+		c.mx.Lock()
+		old, found := c.hashes[key]
+		switch {
+		case fs.err != nil:
+			if os.IsNotExist(fs.err) {
+				delete(c.hashes, key)
+			}
+			changed = append(changed, t)
+		case !found || old != fs.sum:
+			c.hashes[key] = fs.sum
+			changed = append(changed, t)
+		}
+		c.mx.Unlock()
+	}
+	return changed
+}
+
+// record stores the current hash of the files of the runs, ex: when all the commands run
+func (c *hashCache) record(commandsRun map[string]*commandRun) {
+	sums := map[string]fileSum{}
+	for _, run := range commandsRun {
+		c.changedTriggers(run, sums)
+	}
+}
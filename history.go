@@ -0,0 +1,215 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHistory is the number of lines of output kept for each command
+	defaultHistory = 100
+	// reportLines is the number of lines of output included in the report of a failed process
+	reportLines = 20
+)
+
+// ringBuffer keeps the last lines of output of a command
+type ringBuffer struct {
+	mx    sync.Mutex
+	lines []string
+	// total is the number of lines ever added, used to mark the start of a process
+	total int
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{lines: make([]string, size)}
+}
+
+func (r *ringBuffer) add(line string) {
+	r.mx.Lock()
+	r.lines[r.total%len(r.lines)] = line
+	r.total++
+	r.mx.Unlock()
+}
+
+// mark returns the position of the next line, lines since the mark are returned by since
+func (r *ringBuffer) mark() int {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.total
+}
+
+// since returns the lines kept added after mark, at most max lines
+func (r *ringBuffer) since(mark, max int) []string {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	start := r.total - len(r.lines)
+	if start < mark {
+		start = mark
+	}
+	if start < r.total-max {
+		start = r.total - max
+	}
+	var lines []string
+	for i := start; i < r.total; i++ {
+		lines = append(lines, r.lines[i%len(r.lines)])
+	}
+	return lines
+}
+
+// rotatingFile is the log: file of a command, when the file reaches maxSize it's renamed to
+// path.1, the older files to path.2 up to path.maxFiles, and a new file is created
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mx   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func (f *rotatingFile) writeLine(stream string, line string) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	entry := fmt.Sprintf("%s %s %s\n", time.Now().Format("2006/01/02 15:04:05.000"), stream, line)
+	if f.file != nil && f.size+int64(len(entry)) > f.maxSize && f.size > 0 {
+		f.file.Close()
+		f.file = nil
+		f.rotate()
+	}
+
+	if f.file == nil {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			debug("err creating the dir of log %s: %s", f.path, err)
+		}
+		file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			debug("err opening log %s: %s", f.path, err)
+			return
+		}
+		f.file = file
+		f.size = 0
+		if info, err := file.Stat(); err == nil {
+			f.size = info.Size()
+		}
+	}
+
+	n, _ := f.file.WriteString(entry)
+	f.size += int64(n)
+}
+
+func (f *rotatingFile) rotate() {
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+	for i := f.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if f.maxFiles > 0 {
+		os.Rename(f.path, f.path+".1")
+	} else {
+		os.Remove(f.path)
+	}
+}
+
+// logRules returns the ignore rules of the log files of the commands written inside dir and of their rotated
+// files, the logs are written on every line of output and would trigger the commands matching them
+func (s *Service) logRules(dir string) []string {
+	var rules []string
+	for _, commandName := range commandNames(s.Commands) {
+		log := s.Commands[commandName].log
+		if log == nil {
+			continue
+		}
+		if rel, ok := within(dir, log.path); ok && rel != "." {
+			rule := "/" + escapeGlob(rel)
+			rules = append(rules, rule)
+			for i := 1; i <= log.maxFiles; i++ {
+				rules = append(rules, fmt.Sprintf("%s.%d", rule, i))
+			}
+		}
+	}
+	return rules
+}
+
+// parseSize parses a size in bytes with an optional KB, MB or GB suffix
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	s = strings.ToUpper(strings.TrimSpace(s))
+	for _, unit := range units {
+		if strings.HasSuffix(s, unit.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, unit.suffix)), 64)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid size %q", s)
+			}
+			return int64(n * float64(unit.size)), nil
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n, nil
+}
+
+// outputMark returns the mark of the output of a process starting now
+func (cmd *command) outputMark() int {
+	if cmd.history == nil {
+		return 0
+	}
+	return cmd.history.mark()
+}
+
+// reportOutput prints the last lines of output of a failed process of the command, written since mark
+func (cmd *command) reportOutput(mark int) {
+	if cmd.history == nil {
+		return
+	}
+	lines := cmd.history.since(mark, reportLines)
+	if len(lines) == 0 {
+		return
+	}
+	trace("last output of %s:", cmd.name)
+	printLines(lines)
+}
+
+// printHistory prints the output kept of the commands, the commands are sorted by name
+func printHistory(commands map[string]*command) {
+	for _, name := range commandNames(commands) {
+		cmd := commands[name]
+		if cmd.history == nil {
+			continue
+		}
+		lines := cmd.history.since(0, len(cmd.history.lines))
+		trace("output of %s, %d lines:", name, len(lines))
+		printLines(lines)
+	}
+}
+
+func printLines(lines []string) {
+	muxMx.Lock()
+	defer muxMx.Unlock()
+	for _, line := range lines {
+		fmt.Fprintf(os.Stderr, "    %s\n", line)
+	}
+}
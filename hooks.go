@@ -0,0 +1,170 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+const (
+	hookInit      = "oninit"
+	hookStart     = "onstart"
+	hookBeforeRun = "beforeRun"
+	hookAfterRun  = "afterRun"
+	hookFail      = "onfail"
+	hookReady     = "onready"
+	hookStop      = "onstop"
+	hookExit      = "onexit"
+)
+
+// hooks are the commands run on the events of the processes of a command, the hooks of the service
+// run on the events of all the commands, before the hooks of the command when the process starts and
+// after them when it stops. A failing beforeRun hook fails the run, other failing hooks are reported
+type hooks struct {
+	Onstart   string `yaml:"onstart"`
+	BeforeRun string `yaml:"beforeRun"`
+	AfterRun  string `yaml:"afterRun"`
+	Onfail    string `yaml:"onfail"`
+	Onready   string `yaml:"onready"`
+	Onstop    string `yaml:"onstop"`
+}
+
+// get returns the hook named name
+func (h *hooks) get(name string) string {
+	switch name {
+	case hookStart:
+		return h.Onstart
+	case hookBeforeRun:
+		return h.BeforeRun
+	case hookAfterRun:
+		return h.AfterRun
+	case hookFail:
+		return h.Onfail
+	case hookReady:
+		return h.Onready
+	case hookStop:
+		return h.Onstop
+	}
+	return ""
+}
+
+// exitCode returns the exit code of a process that exited with err, -1 when the process didn't exit by itself
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return -1
+}
+
+// runHook runs a hook of the command, the output of the hook is written with the output of the command
+func (cmd *command) runHook(name, hook string, shell shellOption, env ...string) error {
+	if hook == "" {
+		return nil
+	}
+	debug("running %s hook of %s: %q", name, cmd.name, hook)
+	env = append(append(append([]string{}, cmd.Env...), "DEVOP_COMMAND="+cmd.name, "DEVOP_HOOK="+name), env...)
+	// the shell expands the variables of shell hooks itself
+	if shell == "" {
+		hook = os.Expand(hook, expander(env))
+	}
+	proc, err := newProcessCommand(hook, shell)
+	if err != nil {
+		return err
+	}
+	proc.Env = env
+	if cmd.dirTemplate == nil && cmd.Dir != "" {
+		proc.Dir = cmd.Dir
+	}
+	if cmd.stdout != nil {
+		proc.Stdout = cmd.stdout
+	}
+	if cmd.stderr != nil {
+		proc.Stderr = cmd.stderr
+	}
+	err = proc.Run()
+	cmd.flushOutput()
+	return err
+}
+
+// runHooks runs the hook name of the service and of the command, exitErr is the exit error of the process
+// for the hooks run after it stopped, the first error of the hooks is returned
+func (cmd *command) runHooks(name string, exitErr error) error {
+	var env []string
+	switch name {
+	case hookAfterRun, hookFail, hookStop:
+		env = append(env, "DEVOP_EXIT_CODE="+strconv.Itoa(exitCode(exitErr)))
+	}
+
+	type hook struct {
+		command string
+		shell   shellOption
+	}
+	// onstart and onstop of the service run when devop starts and stops
+	order := []hook{{"", ""}, {cmd.hooks.get(name), cmd.Shell}}
+	if name != hookStart && name != hookStop {
+		order[0] = hook{devService.hooks.get(name), devService.Shell}
+	}
+	if name == hookAfterRun || name == hookFail || name == hookStop {
+		order[0], order[1] = order[1], order[0]
+	}
+
+	var first error
+	for _, hook := range order {
+		if err := cmd.runHook(name, hook.command, hook.shell, env...); err != nil {
+			if name != hookBeforeRun {
+				trace("[warning] %s hook of %s failed: %s", name, cmd.name, err)
+			}
+			if first == nil {
+				first = fmt.Errorf("%s hook failed: %s", name, err)
+			}
+			if name == hookBeforeRun {
+				break
+			}
+		}
+	}
+	return first
+}
+
+// runServiceHook runs the onstart and onstop hooks of the service
+func (s *Service) runServiceHook(name string) {
+	hook := s.hooks.get(name)
+	if hook == "" {
+		return
+	}
+	trace("running %s hook", name)
+	env := append(append([]string{}, s.Env...), "DEVOP_HOOK="+name)
+	if s.Shell == "" {
+		hook = os.Expand(hook, expander(env))
+	}
+	proc, err := newProcessCommand(hook, s.Shell)
+	if err == nil {
+		proc.Env = env
+		proc.Dir = s.Dir
+		proc.Stdout = os.Stdout
+		proc.Stderr = os.Stderr
+		err = proc.Run()
+	}
+	if err != nil {
+		trace("[warning] %s hook failed: %s", name, err)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreFiles are read from every scanned directory, their rules apply to the paths inside
+// the directory, the rules declared in the ignore: list of devop.yml are applied last
+var ignoreFiles = []string{".gitignore", ".devopignore"}
+
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreList is a list of gitignore like rules, the last rule matching a path wins
+type ignoreList []ignoreRule
+
+// parseIgnoreRule parses a single gitignore line, ok is false for blank lines and comments
+func parseIgnoreRule(line string) (rule ignoreRule, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return
+	}
+
+	if line[0] == '!' {
+		rule.negate = true
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if line == "" {
+		return
+	}
+
+	// patterns without a slash match the name at any depth, otherwise they are relative to the dir of the rules
+	prefix := "(^|/)"
+	if strings.Contains(line, "/") {
+		prefix = "^"
+		line = strings.TrimPrefix(line, "/")
+	}
+
+	if rule.pattern, err = regexp.Compile(prefix + globToRegexp(line) + "$"); err != nil {
+		return rule, false, fmt.Errorf("invalid ignore rule %q: %s", line, err)
+	}
+	return rule, true, nil
+}
+
+// appendLines appends the rules of each line to the list, invalid rules are reported and skipped
+func (l ignoreList) appendLines(lines []string) ignoreList {
+	for _, line := range lines {
+		rule, ok, err := parseIgnoreRule(line)
+		if err != nil {
+			trace("[warning] skipping %s", err)
+		} else if ok {
+			l = append(l, rule)
+		}
+	}
+	return l
+}
+
+// appendFile appends the rules found in file, a missing file is not an error
+func (l ignoreList) appendFile(file string) ignoreList {
+	f, err := os.Open(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			trace("[warning] can't read ignore file %s: %s", file, err)
+		}
+		return l
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	debug("loading ignore file: %s", file)
+	return l.appendLines(lines)
+}
+
+// match applies the rules to the slash separated relative path, ignored is the result of the
+// rules applied before, the last rule matching the path wins
+func (l ignoreList) match(rel string, isDir bool, ignored bool) bool {
+	for _, rule := range l {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.pattern.MatchString(rel) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// readIgnoreFiles reads the rules of the ignore files of dir
+func readIgnoreFiles(dir string) (l ignoreList) {
+	for _, file := range ignoreFiles {
+		l = l.appendFile(filepath.Join(dir, file))
+	}
+	return
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreList(t *testing.T) {
+	base := filepath.FromSlash("/project")
+	root := &watchRoot{dir: base, rules: ignoreList{}.appendLines([]string{
+		"# comment",
+		".git/",
+		"vendor/",
+		"*.log",
+		"!keep.log",
+		"/devop",
+		"docs/**/*.md",
+		"[z-a].txt",
+	})}
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"/project/main.go", false, false},
+		{"/project/.git", true, true},
+		{"/project/.git/HEAD", false, true},
+		{"/project/vendor/github.com/pkg/pkg.go", false, true},
+		{"/project/cmd/vendor", true, true},
+		{"/project/vendor", false, false},
+		{"/project/server.log", false, true},
+		{"/project/logs/keep.log", false, false},
+		{"/project/devop", false, true},
+		{"/project/cmd/devop", false, false},
+		{"/project/docs/README.md", false, true},
+		{"/project/docs/api/v1/README.md", false, true},
+		{"/project/README.md", false, false},
+		{"/elsewhere/server.log", false, false},
+		{"/project/z.txt", false, false},
+	}
+
+	for _, test := range tests {
+		if ignored := root.ignored(filepath.FromSlash(test.path), test.isDir); ignored != test.ignored {
+			t.Errorf("ignored(%q) = %v, expected %v", test.path, ignored, test.ignored)
+		}
+	}
+}
+
+func TestNestedIgnoreFiles(t *testing.T) {
+	base, err := ioutil.TempDir("", "devop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	files := map[string]string{
+		".gitignore":            "*.log\n/dist\n",
+		"web/.gitignore":        "node_modules/\n/build\n!debug.log\n",
+		"web/app/.devopignore":  "*.tmp\n",
+		"web/app/.gitignore":    "*.map\n",
+		"other/.gitignore":      "*.tmp\n",
+		"web/build/.gitignore":  "!keep.js\n",
+		"web/app/vendor/.keep":  "",
+		"web/app/dist/main.js":  "",
+		"other/web/build/a.txt": "",
+	}
+	for file, content := range files {
+		path := filepath.Join(base, filepath.FromSlash(file))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := newWatchRoot(base, []string{"!web/app/keep.tmp"})
+	for _, dir := range []string{"web", "web/app", "web/build", "other"} {
+		root.loadIgnoreFiles(filepath.Join(base, filepath.FromSlash(dir)), false)
+	}
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"server.log", false, true},
+		{"dist", true, true},
+		{"web/dist", true, false},
+		{"web/server.log", false, true},
+		{"web/debug.log", false, false},
+		{"web/app/debug.log", false, false},
+		{"web/node_modules", true, true},
+		{"web/app/node_modules/pkg/index.js", false, true},
+		{"other/node_modules", true, false},
+		{"web/build", true, true},
+		{"web/build/keep.js", false, true},
+		{"web/app/build", true, false},
+		{"other/web/build/a.txt", false, false},
+		{"web/app/cache.tmp", false, true},
+		{"web/app/keep.tmp", false, false},
+		{"web/cache.tmp", false, false},
+		{"other/cache.tmp", false, true},
+		{"web/app/main.js.map", false, true},
+		{"web/main.js.map", false, false},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(base, filepath.FromSlash(test.path))
+		if ignored := root.ignored(path, test.isDir); ignored != test.ignored {
+			t.Errorf("ignored(%q) = %v, expected %v", test.path, ignored, test.ignored)
+		}
+	}
+
+	// the rules of a modified ignore file apply once it's reloaded
+	ioutil.WriteFile(filepath.Join(base, "web", "app", ".gitignore"), nil, 0644)
+	root.loadIgnoreFiles(filepath.Join(base, "web", "app"), false)
+	if !root.ignored(filepath.Join(base, "web", "app", "main.js.map"), false) {
+		t.Errorf("ignore files reloaded without reload")
+	}
+	root.loadIgnoreFiles(filepath.Join(base, "web", "app"), true)
+	if root.ignored(filepath.Join(base, "web", "app", "main.js.map"), false) {
+		t.Errorf("reloaded ignore file rules not applied")
+	}
+}
+
+func TestLogRules(t *testing.T) {
+	base := filepath.FromSlash("/project")
+	s := &Service{Commands: map[string]*command{
+		"app":   {log: &rotatingFile{path: filepath.FromSlash("/project/logs/app[1].log"), maxFiles: 2}},
+		"other": {log: &rotatingFile{path: filepath.FromSlash("/var/log/other.log"), maxFiles: 3}},
+		"build": {},
+	}}
+	root := &watchRoot{dir: base, rules: ignoreList{}.appendLines(s.logRules(base))}
+
+	tests := []struct {
+		path    string
+		ignored bool
+	}{
+		{"/project/logs/app[1].log", true},
+		{"/project/logs/app[1].log.1", true},
+		{"/project/logs/app[1].log.2", true},
+		{"/project/logs/app[1].log.3", false},
+		{"/project/logs/app1.log", false},
+		{"/project/app[1].log", false},
+		{"/project/logs/other.log", false},
+	}
+
+	for _, test := range tests {
+		if ignored := root.ignored(filepath.FromSlash(test.path), false); ignored != test.ignored {
+			t.Errorf("ignored(%q) = %v, expected %v", test.path, ignored, test.ignored)
+		}
+	}
+}
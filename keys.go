@@ -0,0 +1,233 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// watchPaused is set while watching is paused, the modifications are ignored
+var watchPaused int32
+
+// restoreTerminal restores the mode of the terminal changed to read the keys
+var restoreTerminal = func() {}
+
+const keysHelp = `keys:
+  r       run all the matched commands
+  b name  run the command name and the commands after it
+  k       stop the commands that don't wait
+  p       pause or resume watching
+  c       clear the screen
+  l       list the running processes
+  q       stop the commands and quit
+  h       show this help`
+
+// stty runs stty on the terminal of devop
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// rawTerminal makes the keys available without enter, when stty is not available the keys are read
+// by line, signals like ctrl-c keep working
+func rawTerminal() bool {
+	saved, err := stty("-g")
+	if err != nil {
+		debug("err reading the terminal mode: %s", err)
+		return false
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		debug("err changing the terminal mode: %s", err)
+		return false
+	}
+	restoreTerminal = func() {
+		stty(saved)
+	}
+	return true
+}
+
+// readKeys reads the keys typed in the terminal of devop and runs their actions, with a stdin command
+// the input is forwarded to the command and the keys are typed after the escape key ctrl-]
+func readKeys() {
+	forward := stdinCommand != nil
+	raw := !forward && rawTerminal()
+	if forward {
+		trace("forwarding the input to %s, press ctrl-] h to show the keys", stdinCommand.name)
+	} else {
+		trace("press h to show the keys")
+	}
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		key, err := reader.ReadByte()
+		if err != nil {
+			debug("err reading the keys: %s", err)
+			return
+		}
+		if !forward {
+			runKey(reader, key, raw)
+			continue
+		}
+
+		if key != escapeKey {
+			forwardStdin([]byte{key})
+			continue
+		}
+		if key, err = reader.ReadByte(); err != nil {
+			return
+		}
+		if key == escapeKey {
+			forwardStdin([]byte{key})
+			continue
+		}
+		runKey(reader, key, raw)
+		// the terminal reads by line, the rest of the line of the key is not forwarded
+		if key != 'b' && key != '\n' {
+			reader.ReadString('\n')
+		}
+	}
+}
+
+// runKey runs the action of key
+func runKey(reader *bufio.Reader, key byte, raw bool) {
+	switch key {
+	case 'r':
+		trace("running all the matched commands")
+		go func() {
+			commandsRun := scanAndGetCommands(devService.GetWatchDirs(), commands)
+			contentHashes.record(commandsRun)
+			runNow(commandsRun)
+		}()
+	case 'b':
+		if name := readName(reader, raw); name != "" {
+			runChain(name)
+		}
+	case 'k':
+		go stopApps()
+	case 'p':
+		if atomic.CompareAndSwapInt32(&watchPaused, 0, 1) {
+			trace("watching paused, press p to resume")
+		} else {
+			atomic.StoreInt32(&watchPaused, 0)
+			trace("watching resumed")
+		}
+	case 'c':
+		fmt.Fprint(os.Stdout, "\x1b[H\x1b[2J\x1b[3J")
+	case 'l':
+		listProcesses()
+	case 'q':
+		go shutdown(0)
+	case 'h', '?':
+		printLines(strings.Split(keysHelp, "\n"))
+	}
+}
+
+// readName reads the name of a command typed after b, terminated by enter, escape cancels it
+func readName(reader *bufio.Reader, raw bool) string {
+	if raw {
+		muxMx.Lock()
+		fmt.Fprint(os.Stderr, "command: ")
+		muxMx.Unlock()
+	}
+	var name []byte
+	for {
+		key, err := reader.ReadByte()
+		if err != nil {
+			return ""
+		}
+		switch key {
+		case '\r', '\n':
+			if raw {
+				fmt.Fprintln(os.Stderr)
+			}
+			return strings.TrimSpace(string(name))
+		case 27:
+			if raw {
+				fmt.Fprintln(os.Stderr)
+			}
+			return ""
+		case 8, 127:
+			if len(name) > 0 {
+				name = name[:len(name)-1]
+				if raw {
+					fmt.Fprint(os.Stderr, "\b \b")
+				}
+			}
+		default:
+			name = append(name, key)
+			if raw {
+				os.Stderr.Write([]byte{key})
+			}
+		}
+	}
+}
+
+// runChain runs the command name and the commands that continue or depend on it
+func runChain(name string) {
+	command, found := commands[name]
+	if !found {
+		trace("unknown command %q, the commands are %s", name, strings.Join(commandNames(commands), ", "))
+		return
+	}
+	trace("running command %s", name)
+	go runNow(map[string]*commandRun{command.Command: {command: command}})
+}
+
+// stopApps stops the processes of the commands that don't wait
+func stopApps() {
+	runMutex.Lock()
+	defer runMutex.Unlock()
+	for _, name := range commandNames(commands) {
+		if command := commands[name]; !command.Wait {
+			command.forceKillAllProcess()
+		}
+	}
+	trace("stopped the commands that don't wait")
+}
+
+// listProcesses prints the processes of the commands
+func listProcesses() {
+	var lines []string
+	now := time.Now()
+	for _, name := range commandNames(commands) {
+		command := commands[name]
+		command.mx.Lock()
+		if command.waiting != nil && command.waiting.Process != nil {
+			lines = append(lines, fmt.Sprintf("%s: pid %d, waiting", name, command.waiting.Process.Pid))
+		}
+		for cmdString, process := range command.running {
+			state := "running for " + roundDuration(now.Sub(process.started), time.Second).String()
+			select {
+			case <-process.exited:
+				state = exitStatus(process.err)
+			default:
+			}
+			lines = append(lines, fmt.Sprintf("%s: pid %d, %s: %s", name, process.cmd.Process.Pid, state, cmdString))
+		}
+		command.mx.Unlock()
+	}
+	if len(lines) == 0 {
+		trace("no processes running")
+		return
+	}
+	trace("processes:")
+	printLines(lines)
+}
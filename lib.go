@@ -18,9 +18,17 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v2"
 )
 
 type Service struct {
@@ -29,30 +37,166 @@ type Service struct {
 	Refresh string `yaml:"refresh"`
 	Dir     string `yaml:"dir"`
 
+	Watcher      string `yaml:"watcher"`
+	PollInterval string `yaml:"pollInterval"`
+
+	// LoopLimit is the number of consecutive runs a command can re-trigger itself, -1 disables the detection
+	LoopLimit int `yaml:"loopLimit"`
+	// Concurrency is the number of commands that run in parallel, defaults to the number of CPUs
+	Concurrency int `yaml:"concurrency"`
+
+	// Colors colors the prefixes of the output of the commands: auto, when the output is a terminal, always or never
+	Colors     string `yaml:"colors"`
+	Timestamps bool   `yaml:"timestamps"`
+
 	Env      []string            `yaml:"env"`
+	Watch    []string            `yaml:"watch"`
+	Ignore   []string            `yaml:"ignore"`
 	Commands map[string]*command `yaml:"commands"`
+
+	// hooks of the service, onstart and onstop run when devop starts and stops, the other hooks on the events of all the commands
+	hooks `yaml:",inline"`
+	// Shell is the shell of the hooks of the service
+	Shell shellOption `yaml:"shell"`
+
+	// scope are the dirs which modifications are matched against all commands
+	scope []string
+	roots []*watchRoot
+	// mx guards roots and the watch dirs of the commands, dirs can be added while running
+	mx sync.RWMutex
 }
 
+// watchDirsChanged is signaled when the watched dirs of the service change after Init
+var watchDirsChanged = make(chan struct{}, 1)
+
 type command struct {
-	Building string   `yaml:"-"`
-	Match    string   `yaml:"match"`
-	Command  string   `yaml:"command"`
-	Continue string   `yaml:"continue"`
-	Oninit   string   `yaml:"oninit"`
-	Onexit   string   `yaml:"onexit"`
-	Dir      string   `yaml:"dir"`
-	Env      []string `yaml:"env"`
-
-	Wait   bool `yaml:"wait"`
-	Stderr bool `yaml:"stderr"`
-	Stdout bool `yaml:"stdout"`
+	Building string      `yaml:"-"`
+	Match    string      `yaml:"match"`
+	Glob     []string    `yaml:"glob"`
+	Package  string      `yaml:"goPackage"`
+	Command  string      `yaml:"command"`
+	Continue commandList `yaml:"continue"`
+	Oninit   string      `yaml:"oninit"`
+	Onexit   string      `yaml:"onexit"`
+	Dir      string      `yaml:"dir"`
+	Env      []string    `yaml:"env"`
+	Watch    []string    `yaml:"watch"`
+	On       []string    `yaml:"on"`
+	Outputs  []string    `yaml:"outputs"`
+
+	// hooks run on the events of the processes of the command
+	hooks `yaml:",inline"`
+
+	DependsOn commandList `yaml:"dependsOn"`
+	OnSuccess commandList `yaml:"onSuccess"`
+	OnFailure commandList `yaml:"onFailure"`
+
+	Shell    shellOption `yaml:"shell"`
+	Debounce string      `yaml:"debounce"`
 
+	StopSignal  string `yaml:"stopSignal"`
+	StopTimeout string `yaml:"stopTimeout"`
+
+	Ready *readyProbe `yaml:"ready"`
+
+	// Timeout stops the commands that wait when they run longer than the duration
+	Timeout string `yaml:"timeout"`
+
+	Restart string `yaml:"restart"`
+	// MaxRestarts is the number of consecutive restarts before a crashing command is given up, -1 is unlimited
+	MaxRestarts int `yaml:"maxRestarts"`
+	// Retries is the number of times a failed command that waits runs again
+	Retries int    `yaml:"retries"`
+	Backoff string `yaml:"backoff"`
+
+	Settle string `yaml:"settle"`
+
+	Batch bool `yaml:"batch"`
+	// CancelOnChange cancels the running wait commands when the command is matched while running
+	CancelOnChange bool `yaml:"cancelOnChange"`
+	Wait           bool `yaml:"wait"`
+	Stderr         bool `yaml:"stderr"`
+	Stdout         bool `yaml:"stdout"`
+	// Stdin forwards the input of devop to the command, only one command can read it
+	Stdin bool `yaml:"stdin"`
+
+	// Prefix is the prefix of the output lines of the command, defaults to the name of the command
+	Prefix prefixOption `yaml:"prefix"`
+	Color  string       `yaml:"color"`
+
+	// Log is the file the output of the command is written to, rotated when it reaches LogMaxSize
+	Log         string `yaml:"log"`
+	LogMaxSize  string `yaml:"logMaxSize"`
+	LogMaxFiles int    `yaml:"logMaxFiles"`
+	// History is the number of lines of output kept in memory, -1 disables the history
+	History int `yaml:"history"`
+
+	name    string
 	pattern *regexp.Regexp
+	glob    *globMatcher
+	outputs *globMatcher
+	// bases are the dirs the matched paths are relative to
+	bases []string
+	// ownDir is the dir of the command when it's not the project dir, files written there are written by the command
+	ownDir string
+	events eventOp
+	watch  []string
+	deps   *goDeps
+	// depDirs are the dirs of the dependencies of the go package, guarded by Service.mx
+	depDirs []string
+	// next are the commands that run after the command
+	next []commandEdge
+
+	commandTemplate *template.Template
+	dirTemplate     *template.Template
+	envTemplates    map[int]*template.Template
+
+	stopSignal  os.Signal
+	stopTimeout time.Duration
 
-	running map[string]*exec.Cmd
+	debounce time.Duration
+	settle   time.Duration
+	// pendingSince and lastEvent are the times of the first and the last event that queued
+	// the command, timer wakes the runner when the debounce window ends, guarded by pendingMx
+	pendingSince time.Time
+	lastEvent    time.Time
+	timer        *time.Timer
+
+	// mx guards the state of the processes of the command used to detect loops
+	mx             sync.Mutex
+	active         int
+	runs           int
+	lastActive     time.Time
+	retriggeredRun int
+	loopStart      time.Time
+	loopCount      int
+	// loopPaths re-triggered the previous run of the loop, runPaths the last run
+	loopPaths      []string
+	runPaths       []string
+	suspendedUntil time.Time
+	// waiting is the process of a wait command the runner is waiting for
+	waiting *exec.Cmd
+
+	timeout time.Duration
+
+	// stdout and stderr are the writers of the output of the command, nil when the output is discarded
+	stdout  *lineWriter
+	stderr  *lineWriter
+	history *ringBuffer
+	log     *rotatingFile
+
+	readyPattern *regexp.Regexp
+	readyTimeout time.Duration
+
+	restart restartPolicy
+	backoff time.Duration
+	// running are the processes of the command that doesn't wait, changed with runMutex and mx locked
+	running map[string]*process
 }
 
-func (s *Service) Init() {
+// Init initializes the service and the commands, the oninit hooks of the commands run when all the commands
+// are initialized, the first error aborts the start of devop
+func (s *Service) Init() error {
 
 	if _port != nil && *_port != "" {
 		ports := strings.SplitN(*_port, ":", 2)
@@ -79,6 +223,32 @@ func (s *Service) Init() {
 	} else if s.Refresh == "" {
 		s.Refresh = ".5s"
 	}
+	if refresh, err := time.ParseDuration(s.Refresh); err != nil || refresh <= 0 {
+		return fmt.Errorf("invalid refresh %q", s.Refresh)
+	}
+
+	switch s.Watcher {
+	case "":
+		s.Watcher = watcherNative
+	case watcherNative, watcherPoll:
+	default:
+		return fmt.Errorf("unknown watcher %q, the watchers are %s and %s", s.Watcher, watcherNative, watcherPoll)
+	}
+
+	if s.PollInterval == "" {
+		s.PollInterval = "1s"
+	}
+	if interval, err := time.ParseDuration(s.PollInterval); err != nil || interval <= 0 {
+		return fmt.Errorf("invalid pollInterval %q", s.PollInterval)
+	}
+
+	if s.LoopLimit == 0 {
+		s.LoopLimit = 5
+	}
+
+	if s.Concurrency <= 0 {
+		s.Concurrency = runtime.NumCPU()
+	}
 
 	if s.Dir == "" {
 		s.Dir, _ = os.Getwd()
@@ -89,23 +259,128 @@ func (s *Service) Init() {
 	s.Env = append(append([]string{}, os.Environ()...), s.Env...)
 	sExpander := expander(s.Env)
 
+	s.scope = []string{s.Dir}
+	for _, dir := range s.Watch {
+		s.scope = append(s.scope, absPath(s.Dir, os.Expand(dir, sExpander)))
+	}
+
+	for _, command := range s.Commands {
+		for _, dir := range command.Watch {
+			command.watch = append(command.watch, absPath(s.Dir, os.Expand(dir, sExpander)))
+		}
+	}
+	if err := s.initOutput(); err != nil {
+		return err
+	}
+	s.updateRoots()
+
 	for commandName, command := range s.Commands {
 
 		if *_debug {
 			trace("loading command: %v pattern: %v cmd: %v", commandName, command.Match, command.Command)
 		}
 
+		command.name = commandName
+
 		if command.Match != "" {
-			command.pattern = regexp.MustCompile(command.Match)
+			pattern, err := regexp.Compile(command.Match)
+			if err != nil {
+				return fmt.Errorf("command %s: invalid match: %s", commandName, err)
+			}
+			command.pattern = pattern
+		}
+
+		events, err := parseEventOps(command.On)
+		if err != nil {
+			return fmt.Errorf("command %s: %s", commandName, err)
+		}
+		command.events = events
+
+		if command.Debounce != "" {
+			if command.debounce, err = time.ParseDuration(command.Debounce); err != nil {
+				return fmt.Errorf("command %s: invalid debounce: %s", commandName, err)
+			}
+		}
+
+		if command.Settle != "" {
+			if command.settle, err = time.ParseDuration(command.Settle); err != nil {
+				return fmt.Errorf("command %s: invalid settle: %s", commandName, err)
+			} else if command.debounce == 0 {
+				trace("[warning] command %s: settle has no effect without debounce", commandName)
+			}
+		}
+
+		if command.StopSignal == "" {
+			command.StopSignal = "SIGTERM"
+		}
+		if command.stopSignal, err = parseSignal(command.StopSignal); err != nil {
+			return fmt.Errorf("command %s: invalid stopSignal: %s", commandName, err)
+		}
+
+		command.stopTimeout = 5 * time.Second
+		if command.StopTimeout != "" {
+			if command.stopTimeout, err = time.ParseDuration(command.StopTimeout); err != nil {
+				return fmt.Errorf("command %s: invalid stopTimeout: %s", commandName, err)
+			}
+		}
+
+		if command.Timeout != "" {
+			if command.timeout, err = time.ParseDuration(command.Timeout); err != nil {
+				return fmt.Errorf("command %s: invalid timeout: %s", commandName, err)
+			} else if !command.Wait {
+				trace("[warning] command %s: timeout has no effect on commands that don't wait", commandName)
+			}
+		}
+
+		if command.Ready != nil {
+			command.readyTimeout = 30 * time.Second
+			if command.Ready.Timeout != "" {
+				if command.readyTimeout, err = time.ParseDuration(command.Ready.Timeout); err != nil {
+					return fmt.Errorf("command %s: invalid ready timeout: %s", commandName, err)
+				}
+			}
+			if command.Ready.Stdout != "" {
+				if command.readyPattern, err = regexp.Compile(command.Ready.Stdout); err != nil {
+					return fmt.Errorf("command %s: invalid ready stdout regex: %s", commandName, err)
+				}
+			}
+			if command.Wait {
+				trace("[warning] command %s: ready has no effect on commands that wait", commandName)
+			}
+		}
+
+		if command.restart, err = parseRestartPolicy(command.Restart); err != nil {
+			return fmt.Errorf("command %s: %s", commandName, err)
+		}
+		if command.restart != restartNever && command.Wait {
+			trace("[warning] command %s: restart has no effect on commands that wait, use retries", commandName)
+		}
+		if command.MaxRestarts == 0 {
+			command.MaxRestarts = 5
+		}
+
+		command.backoff = time.Second
+		if command.Backoff != "" {
+			if command.backoff, err = time.ParseDuration(command.Backoff); err != nil {
+				return fmt.Errorf("command %s: invalid backoff: %s", commandName, err)
+			}
 		}
 
 		if !command.Wait {
-			command.running = make(map[string]*exec.Cmd)
+			command.running = make(map[string]*process)
 		}
 
+		command.envTemplates = map[int]*template.Template{}
 		if len(command.Env) > 0 {
 			for i := 0; i < len(command.Env); i++ {
 				command.Env[i] = os.Expand(command.Env[i], sExpander)
+				tmpl, err := parseTemplate(commandName, command.Env[i])
+				if err != nil {
+					return fmt.Errorf("command %s: env: %s", commandName, err)
+				}
+				if tmpl != nil {
+					command.envTemplates[len(s.Env)+i] = tmpl
+				}
 			}
 			command.Env = append(append(make([]string, 0, len(s.Env)), s.Env...), command.Env...)
 		} else {
@@ -116,23 +391,174 @@ func (s *Service) Init() {
 
 		command.Onexit = os.Expand(command.Onexit, expander)
 		command.Oninit = os.Expand(command.Oninit, expander)
-		command.Command = os.Expand(command.Command, expander)
+		// the shell expands the variables of shell commands itself
+		if command.Shell == "" {
+			command.Command = os.Expand(command.Command, expander)
+		}
+		if command.commandTemplate, err = parseTemplate(commandName, command.Command); err != nil {
+			return fmt.Errorf("command %s: command: %s", commandName, err)
+		}
 
+		// the paths are relative to the dir of the command, or the project dir, and to the watched dirs
+		base := s.Dir
 		if command.Dir != "" {
-			command.Dir, _ = filepath.Abs(os.Expand(command.Dir, expander))
+			command.Dir = os.Expand(command.Dir, expander)
+			if command.dirTemplate, err = parseTemplate(commandName, command.Dir); err != nil {
+				return fmt.Errorf("command %s: dir: %s", commandName, err)
+			}
+			if command.dirTemplate == nil {
+				command.Dir, _ = filepath.Abs(command.Dir)
+				base = command.Dir
+				if base != s.Dir {
+					command.ownDir = base
+				}
+			}
+		}
+
+		if command.Package != "" {
+			command.deps = newGoDeps(command.Package, base, command.Env)
+			if err := command.deps.load(); err != nil {
+				trace("[warning] command %s: can't load the dependencies of go package %s: %s", commandName, command.Package, err)
+			}
+			s.setDepDirs(command, command.deps.dirs())
+		}
+
+		command.bases = append(append(append([]string{base}, s.scope[1:]...), command.watch...), command.depDirs...)
+
+		if len(command.Glob) > 0 {
+			if command.glob, err = newGlobMatcher(command.bases, command.Glob); err != nil {
+				return fmt.Errorf("command %s: invalid glob: %s", commandName, err)
+			}
+		}
+		if len(command.Outputs) > 0 {
+			if command.outputs, err = newGlobMatcher(command.bases, command.Outputs); err != nil {
+				return fmt.Errorf("command %s: invalid outputs: %s", commandName, err)
+			}
 		}
 
+	}
+
+	for _, commandName := range commandNames(s.Commands) {
+		command := s.Commands[commandName]
 		if command.Oninit != "" {
-			trace("Running init command for %s: %q", commandName, command.Oninit)
-			cmd := newProcessCommand(command.Oninit)
-			cmd.Env = command.Env
-			err := cmd.Run()
-			if err != nil {
-				trace("err:%s", err)
-				return
+			trace("running init command for %s: %q", commandName, command.Oninit)
+			if err := command.runHook(hookInit, command.Oninit, command.Shell); err != nil {
+				return fmt.Errorf("init command of %s failed: %s", commandName, err)
 			}
 		}
 	}
+	return nil
+}
+
+// matches reports if path matches the regex, the globs and the go package of the command, commands
+// without a match, glob or goPackage are only executed as continuation of other commands
+func (cmd *command) matches(path string) bool {
+	if cmd.pattern == nil && cmd.glob == nil && cmd.deps == nil {
+		return false
+	}
+	return (cmd.pattern == nil || cmd.pattern.MatchString(path)) &&
+		(cmd.glob == nil || cmd.glob.match(path)) &&
+		(cmd.deps == nil || cmd.deps.contains(path))
+}
+
+// touch records an event that queued the command and schedules the run at the end of the
+// debounce window, the window is capped by settle and extended until the end of a suspension,
+// must be called with pendingMx locked
+func (cmd *command) touch(now time.Time) {
+	if cmd.pendingSince.IsZero() {
+		cmd.pendingSince = now
+	}
+	cmd.lastEvent = now
+
+	wait := cmd.debounce
+	if cmd.debounce > 0 && cmd.settle > 0 {
+		if left := cmd.settle - now.Sub(cmd.pendingSince); left < wait {
+			wait = left
+		}
+	}
+
+	// the runs queued while the command is suspended wait for the end of the suspension
+	suspended := cmd.suspendedFor(now)
+	if suspended > wait {
+		wait = suspended
+	} else if cmd.debounce == 0 {
+		return
+	}
+
+	if cmd.timer == nil {
+		cmd.timer = time.AfterFunc(wait, runCommandsIfneeded)
+	} else {
+		cmd.timer.Reset(wait)
+	}
+}
+
+// ready reports if the command is not suspended and has no debounce window or if no events arrived
+// during the window or settle elapsed since the first event, must be called with pendingMx locked
+func (cmd *command) ready(now time.Time) bool {
+	if cmd.suspendedFor(now) > 0 {
+		return false
+	}
+	if cmd.debounce == 0 {
+		return true
+	}
+	return now.Sub(cmd.lastEvent) >= cmd.debounce || (cmd.settle > 0 && now.Sub(cmd.pendingSince) >= cmd.settle)
+}
+
+// deprecatedOptions are the options of the commands that are accepted and have no effect
+var deprecatedOptions = map[string]string{
+	"kill": "the commands that don't wait are always stopped before they run again",
+}
+
+// validateConfig reports the options of the devop.yml file that are not options of the service or of a command
+func validateConfig(data []byte) error {
+	var config struct {
+		Service  map[string]interface{}            `yaml:",inline"`
+		Commands map[string]map[string]interface{} `yaml:"commands"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return err
+	}
+
+	var unknown []string
+	serviceOptions := yamlOptions(reflect.TypeOf(Service{}))
+	for option := range config.Service {
+		if !serviceOptions[option] {
+			unknown = append(unknown, fmt.Sprintf("%q", option))
+		}
+	}
+
+	commandOptions := yamlOptions(reflect.TypeOf(command{}))
+	for commandName, options := range config.Commands {
+		for option := range options {
+			if reason, found := deprecatedOptions[option]; found {
+				trace("[warning] command %s: %s is deprecated and has no effect, %s", commandName, option, reason)
+			} else if !commandOptions[option] {
+				unknown = append(unknown, fmt.Sprintf("%q in command %s", option, commandName))
+			}
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown options: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// yamlOptions returns the yaml keys of the exported fields of t and of the inlined structs
+func yamlOptions(t reflect.Type) map[string]bool {
+	options := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		tags := strings.Split(t.Field(i).Tag.Get("yaml"), ",")
+		if len(tags) > 1 && tags[1] == "inline" && t.Field(i).Type.Kind() == reflect.Struct {
+			for option := range yamlOptions(t.Field(i).Type) {
+				options[option] = true
+			}
+		} else if tags[0] != "" && tags[0] != "-" {
+			options[tags[0]] = true
+		}
+	}
+	return options
 }
 
 func expander(envs []string) func(string) string {
@@ -154,3 +580,106 @@ func (s *Service) GetRoot() string {
 func (s *Service) GetEnv() []string {
 	return s.Env
 }
+
+// GetWatchDirs returns the dirs that need to be scanned and watched, dirs nested in other dirs are omitted
+func (s *Service) GetWatchDirs() []string {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	var dirs []string
+	for _, root := range s.roots {
+		dirs = append(dirs, root.dir)
+	}
+	return collapseDirs(dirs)
+}
+
+// ignored reports if path is excluded from the scan and the modifications tracker
+func (s *Service) ignored(path string, isDir bool) bool {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	for _, root := range s.roots {
+		if root.ignored(path, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadIgnoreFiles reads the ignore files of dir in the roots containing it, the files are read
+// again when reload is set, ex: when they are modified
+func (s *Service) loadIgnoreFiles(dir string, reload bool) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	for _, root := range s.roots {
+		root.loadIgnoreFiles(dir, reload)
+	}
+}
+
+// inScope reports if modifications of path are matched against cmd, paths in the project dir
+// and in the service watch dirs are matched against all commands, paths in the watch dirs of
+// a command only against the command
+func (s *Service) inScope(cmd *command, path string) bool {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return withinAny(s.scope, path) || withinAny(cmd.watch, path) || withinAny(cmd.depDirs, path)
+}
+
+// setDepDirs replaces the dirs of the dependencies of the go package of cmd, the dirs
+// no command needs anymore are not watched, the modifications tracker is signaled
+// when the watched dirs changed
+func (s *Service) setDepDirs(cmd *command, dirs []string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	cmd.depDirs = dirs
+	if s.updateRoots() {
+		select {
+		case watchDirsChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// updateRoots creates the roots of the service dirs and of the dirs of the commands, the roots
+// of the dirs that are still watched are kept, it reports if the watched dirs changed
+func (s *Service) updateRoots() (changed bool) {
+	old := map[string]*watchRoot{}
+	for _, root := range s.roots {
+		old[root.dir] = root
+	}
+
+	dirs := append([]string{}, s.scope...)
+	for _, commandName := range commandNames(s.Commands) {
+		dirs = append(append(dirs, s.Commands[commandName].watch...), s.Commands[commandName].depDirs...)
+	}
+
+	s.roots = nil
+	for _, dir := range dirs {
+		root, found := old[dir]
+		if !found {
+			debug("watching dir: %s", dir)
+			root = newWatchRoot(dir, append(append([]string{}, s.Ignore...), s.logRules(dir)...))
+			changed = true
+		} else if root == nil {
+			// duplicated dir
+			continue
+		}
+		old[dir] = nil
+		s.roots = append(s.roots, root)
+	}
+
+	for dir, root := range old {
+		if root != nil {
+			debug("not watching dir anymore: %s", dir)
+			changed = true
+		}
+	}
+	return
+}
+
+// reloadGoDeps reloads the dependencies of the go package of cmd when path can change them
+func (s *Service) reloadGoDeps(cmd *command, path string) {
+	if cmd.deps != nil && cmd.deps.affectedBy(path) {
+		cmd.deps.reload(func() {
+			s.setDepDirs(cmd, cmd.deps.dirs())
+		})
+	}
+}
@@ -14,6 +14,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -26,7 +27,9 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unicode/utf8"
@@ -66,10 +69,30 @@ func main() {
 	}
 
 	debug("parsing devop yml file")
-	yaml.Unmarshal(devopfile, &devService)
+	if err := validateConfig(devopfile); err != nil {
+		trace("invalid devop.yml: %s", err)
+		return
+	}
+	if err := yaml.Unmarshal(devopfile, &devService); err != nil {
+		trace("invalid devop.yml: %s", err)
+		return
+	}
+
+	if err := devService.resolveGraph(); err != nil {
+		trace("invalid devop.yml: %s", err)
+		return
+	}
+
+	if stdinCommand, err = devService.findStdinCommand(); err != nil {
+		trace("invalid devop.yml: %s", err)
+		return
+	}
 
 	trace("initializing commands and configs")
-	devService.Init()
+	if err := devService.Init(); err != nil {
+		trace("can't start devop: %s", err)
+		os.Exit(1)
+	}
 
 	appHost = fmt.Sprintf("%s:%s", "127.0.0.1", devService.AppPort)
 
@@ -77,29 +100,37 @@ func main() {
 	commands = devService.Commands
 
 	trace("commands are loaded")
-	trace("running initial command scan")
-	runCommands(scanAndGetCommands(root, commands), commands)
 
+	// the commands run in their own process groups, they are stopped by devop when it's interrupted,
+	// terminated, when it's terminal is closed or on quit, SIGKILL can't be caught
 	go func() {
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
 		<-c
-		for commandName, command := range commands {
-			command.forceKillAllProcess()
-			if command.Onexit != "" {
-				trace("running on exit command of %s", commandName)
-				cmd := newProcessCommand(command.Onexit)
-				cmd.Env = command.Env
-				cmd.Run()
-			}
-		}
-		trace("devop is exiting")
-		os.Exit(1)
+		shutdown(1)
 	}()
 
-	var dialer = &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
+	trace("running initial command scan")
+	runMutex.Lock()
+	commandsRun := scanAndGetCommands(devService.GetWatchDirs(), commands)
+	contentHashes.record(commandsRun)
+	runCommands(commandsRun)
+	runMutex.Unlock()
+
+	devService.runServiceHook(hookStart)
+
+	if isTerminal(os.Stdin) || stdinCommand != nil {
+		go readKeys()
+	}
+
+	if len(historySignals) > 0 {
+		go func() {
+			c := make(chan os.Signal, 1)
+			signal.Notify(c, historySignals...)
+			for range c {
+				printHistory(commands)
+			}
+		}()
 	}
 
 	trace("starting file system modifications tracker")
@@ -110,34 +141,47 @@ func main() {
 
 	if devService.DevPort != "" {
 		trace("starting proxy server on: http://localhost:%v -> http://localhost:%v", devService.DevPort, devService.AppPort)
-		http.ListenAndServe(fmt.Sprintf(":%s", devService.DevPort), &httputil.ReverseProxy{
+		err := http.ListenAndServe(fmt.Sprintf(":%s", devService.DevPort), &httputil.ReverseProxy{
 			Director: director,
 			Transport: &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-				Dial: func(network, address string) (net.Conn, error) {
-					con, err := dialer.Dial(network, address)
-					if err != nil {
-						var i = 0
-						for {
-							<-time.After(time.Millisecond * 10)
-							con, err = dialer.Dial(network, address)
-							if err == nil || i > 500 {
-								break
-							}
-							i++
-						}
-					}
-					return con, err
-				},
+				Proxy:                 http.ProxyFromEnvironment,
+				Dial:                  dialApp(devService.readyProbed()),
 				TLSHandshakeTimeout:   10 * time.Second,
 				ExpectContinueTimeout: 1 * time.Second,
 			},
 		})
+		// the commands are stopped and the terminal restored when the proxy can't listen
+		trace("err starting proxy server on port %s: %s", devService.DevPort, err)
+		shutdown(1)
 	} else {
 		<-(chan struct{})(nil)
 	}
 }
 
+// dialApp returns the dial function of the proxy, when the app is not listening yet the connection is
+// retried with backoff for dialTimeout, the requests wait for the ready probes instead when there are probes
+func dialApp(readyProbed bool) func(network, address string) (net.Conn, error) {
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return func(network, address string) (net.Conn, error) {
+		con, err := d.Dial(network, address)
+		if readyProbed {
+			return con, err
+		}
+		delay := 10 * time.Millisecond
+		for deadline := time.Now().Add(dialTimeout); err != nil && time.Now().Before(deadline); {
+			time.Sleep(delay)
+			if delay *= 2; delay > maxDialDelay {
+				delay = maxDialDelay
+			}
+			con, err = d.Dial(network, address)
+		}
+		return con, err
+	}
+}
+
 func autoRefresher() {
 	duration, err := time.ParseDuration(devService.Refresh)
 	if err != nil {
@@ -150,37 +194,128 @@ func autoRefresher() {
 	}()
 }
 
-var pendingCommands = make(map[string]*command)
+const (
+	// dialTimeout is how long the proxy retries to connect to an app without ready probes
+	dialTimeout = 5 * time.Second
+	// maxDialDelay caps the delay between the connection attempts
+	maxDialDelay = 500 * time.Millisecond
+)
+
+var pendingCommands = make(map[string]*commandRun)
 
 var pendingMx = sync.Mutex{}
 var runMutex = sync.Mutex{}
 
+// queueCommands adds the matched commands to pendingCommands, the triggers
+// of a command that is already pending are added to the pending run
+func queueCommands(commandsRun map[string]*commandRun) {
+	var queued []*commandRun
+	defer func() {
+		for _, run := range queued {
+			cancelInflight(run.command, run.lastTrigger().File)
+		}
+	}()
+
+	pendingMx.Lock()
+	defer pendingMx.Unlock()
+	now := time.Now()
+	for cmdString, run := range commandsRun {
+		suspended := run.retrigger(run.lastTrigger().File, now, devService.LoopLimit)
+		if suspended {
+			debug("command %s is suspended, queued until the end of the suspension: %s", run.name, cmdString)
+		}
+		if pending, found := pendingCommands[cmdString]; found {
+			for _, t := range run.triggers {
+				pending.addTrigger(t)
+			}
+		} else {
+			pendingCommands[cmdString] = run
+		}
+		run.touch(now)
+		// a suspended command doesn't cancel it's running chain
+		if !suspended {
+			queued = append(queued, run)
+		}
+	}
+}
+
+// runCommandsIfneeded runs the pending commands which debounce windows are over,
+// the other commands are kept pending
 func runCommandsIfneeded() {
 	pendingMx.Lock()
-	commandsToRun := pendingCommands
-	hasCommands := len(commandsToRun) > 0
-	if hasCommands {
-		pendingCommands = make(map[string]*command)
+	now := time.Now()
+	commandsToRun := map[string]*commandRun{}
+	for cmdString, run := range pendingCommands {
+		if run.ready(now) {
+			commandsToRun[cmdString] = run
+			delete(pendingCommands, cmdString)
+		}
+	}
+	for _, run := range commandsToRun {
+		run.pendingSince = time.Time{}
 	}
 	pendingMx.Unlock()
+
+	// the files are compared once the window is over, a file rewritten in place or replaced
+	// by a save with the same content doesn't run the command
+	sums := map[string]fileSum{}
+	for cmdString, run := range commandsToRun {
+		if len(run.triggers) == 0 {
+			continue
+		}
+		if run.triggers = contentHashes.changedTriggers(run, sums); len(run.triggers) == 0 {
+			debug("ignoring %s, content of the files unchanged", cmdString)
+			delete(commandsToRun, cmdString)
+		}
+	}
+	runNow(commandsToRun)
+}
+
+// runNow runs the commands and their continuations as a chain, waits for the running chain
+func runNow(commandsToRun map[string]*commandRun) {
 	runMutex.Lock()
 	defer runMutex.Unlock()
-	if hasCommands {
-		runCommands(commandsToRun, commands)
+	if len(commandsToRun) > 0 {
+		startInflight()
+		runCommands(commandsToRun)
+		endInflight()
+	}
+}
+
+// shutdown stops the commands, runs the onexit commands and exits
+func shutdown(code int) {
+	cancelAll()
+	runMutex.Lock()
+	for _, commandName := range commandNames(commands) {
+		command := commands[commandName]
+		command.forceKillAllProcess()
+		if command.Onexit != "" {
+			trace("running on exit command of %s", commandName)
+			if err := command.runHook(hookExit, command.Onexit, command.Shell); err != nil {
+				trace("[warning] on exit command of %s failed: %s", commandName, err)
+			}
+		}
 	}
+	devService.runServiceHook(hookStop)
+	restoreTerminal()
+	trace("devop is exiting")
+	os.Exit(code)
 }
 func director(req *http.Request) {
 	req.URL.Host = appHost
 	req.URL.Scheme = "http"
 	runCommandsIfneeded()
+	waitReady()
 }
 
-func killCommand(cmdString string, command *command, commandRoot map[string]*command) {
-	if _, ok := command.running[cmdString]; ok {
+func killCommand(cmdString string, command *command) {
+	if _, ok := command.runningProcess(cmdString); ok {
 
-		if command.Continue != "" {
-			if command, has := commandRoot[command.Continue]; has && command.Wait == false {
-				killCommand(command.Command, command, commandRoot)
+		for _, edge := range command.next {
+			if next := edge.command; next.Wait == false {
+				for _, nextString := range next.runningCommands() {
+					killCommand(nextString, next)
+				}
 			}
 		}
 
@@ -189,52 +324,157 @@ func killCommand(cmdString string, command *command, commandRoot map[string]*com
 	}
 }
 
-// runCommand runs a single command and all it's continuations
-// if command has a command continuation it's will be invoked
-func runCommand(cmdString string, command *command, commandRoot map[string]*command) {
+// runCommand runs a single command, commands that wait are retried up to retries times when they fail,
+// the commands that don't wait are started and restarted by their restart policy
+func runCommand(cmdString string, run *commandRun) error {
+	command := run.command
+
+	if !enterInflight(command) {
+		debug("skipping cancelled command: %s", cmdString)
+		return errCancelled
+	}
 
 	if command.Wait == false {
-		killCommand(cmdString, command, commandRoot)
+		killCommand(cmdString, command)
+		return command.startProcess(cmdString, run, 0)
 	}
 
-	cmd := newProcessCommand(cmdString)
-	cmd.Env = command.Env
-	if command.Dir != "" {
-		cmd.Dir = command.Dir
+	for attempt := 0; ; attempt++ {
+		mark := command.outputMark()
+		err := command.runProcess(run)
+		if err == nil || err == errCancelled {
+			return err
+		}
+		if attempt >= command.Retries {
+			trace("command %s failed: %s", command.name, err)
+			command.reportOutput(mark)
+			return err
+		}
+		delay := command.backoffDelay(attempt)
+		trace("command %s failed, attempt %d of %d: %s, retrying in %s", command.name, attempt+1, command.Retries+1, err, delay)
+		command.reportOutput(mark)
+		time.Sleep(delay)
+		if inflightCancelled() {
+			return errCancelled
+		}
 	}
+}
+
+// newProcess creates the process of the run, the command, env and dir are expanded with the triggers of the run
+func (run *commandRun) newProcess() (string, *exec.Cmd, error) {
+	command := run.command
 
-	if command.Stderr {
-		cmd.Stderr = os.Stderr
+	// the runs of matched commands are keyed by the expanded command, continuations and batches by the command
+	t := run.lastTrigger()
+	if command.Batch {
+		t = run.batchTrigger()
+	}
+	commandStr, err := command.expandCommand(t)
+	if err != nil {
+		trace("err expanding command %s: %s", command.name, err)
+		return "", nil, err
 	}
 
-	if command.Stdout {
-		cmd.Stdout = os.Stdout
+	env, err := command.expandEnv(t)
+	if err != nil {
+		trace("err expanding env of command %s: %s", command.name, err)
+		return "", nil, err
 	}
 
-	if !command.Wait {
-		//cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-		// if command kill option is activated the command will be stored and killed in next match run
-		command.running[cmdString] = cmd
+	dir, err := command.expandDir(t)
+	if err != nil {
+		trace("err expanding dir of command %s: %s", command.name, err)
+		return "", nil, err
 	}
 
-	trace("running command: %s", cmdString)
-	err := cmd.Start()
+	cmd, err := newProcessCommand(commandStr, command.Shell)
 	if err != nil {
-		log.Println(err.Error())
-		return
+		trace("err parsing command %s: %s", command.name, err)
+		return "", nil, err
+	}
+	cmd.Env = env
+	if dir != "" {
+		cmd.Dir = dir
 	}
 
-	if command.Wait {
-		err = cmd.Wait()
-		if err != nil {
-			log.Println(err.Error())
-			return
+	if command.stderr != nil {
+		cmd.Stderr = command.stderr
+	}
+
+	if command.stdout != nil {
+		cmd.Stdout = command.stdout
+	}
+
+	if command.Batch {
+		cmd.Stdin = strings.NewReader(strings.Join(t.Files, "\n") + "\n")
+	}
+
+	if command.Stdin {
+		if err := attachStdin(cmd); err != nil {
+			trace("err forwarding the input to %s: %s", command.name, err)
+			return "", nil, err
 		}
 	}
 
+	// the command runs in it's own process group, stopping the command stops the processes it started
+	setProcessGroup(cmd)
+	return commandStr, cmd, nil
 }
 
-func BreakCommandString(commandStr string) []string {
+// runProcess runs a process of a command that waits, the process is stopped when the chain is cancelled
+func (command *command) runProcess(run *commandRun) error {
+	if err := command.runHooks(hookBeforeRun, nil); err != nil {
+		return err
+	}
+
+	commandStr, cmd, err := run.newProcess()
+	if err != nil {
+		return err
+	}
+
+	trace("running command: %s", commandStr)
+	command.started()
+	if err = cmd.Start(); err != nil {
+		command.stopped()
+		trace("command %s failed to start: %s", command.name, err)
+		command.runHooks(hookFail, err)
+		return err
+	}
+	command.runHooks(hookStart, nil)
+
+	command.setWaiting(cmd)
+	var timedOut int32
+	if command.timeout > 0 {
+		timer := time.AfterFunc(command.timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			trace("command %s timed out after %s, stopping it", command.name, command.timeout)
+			command.interrupt()
+		})
+		defer timer.Stop()
+	}
+	err = cmd.Wait()
+	command.setWaiting(nil)
+	detachStdin(cmd)
+	command.flushOutput()
+	command.stopped()
+	// a process stopped by the timeout timed out even when it exits cleanly on the stop signal
+	if atomic.LoadInt32(&timedOut) == 1 {
+		err = timeoutError{command.timeout}
+	} else if err != nil && inflightCancelled() {
+		trace("command %s cancelled", command.name)
+		command.runHooks(hookAfterRun, err)
+		return errCancelled
+	}
+
+	command.runHooks(hookAfterRun, err)
+	if err != nil {
+		command.runHooks(hookFail, err)
+	}
+	return err
+}
+
+// BreakCommandString splits the command string in arguments, the quoted strings are unquoted
+func BreakCommandString(commandStr string) ([]string, error) {
 	var (
 		commandBreak []string
 		lexState     = 0
@@ -272,8 +512,7 @@ func BreakCommandString(commandStr string) []string {
 			case '"':
 				_break, err := unQuote(commandStr[lexStart : pos+1])
 				if err != nil {
-					trace("unexpected error parsing command string: %s", err)
-					os.Exit(0)
+					return nil, fmt.Errorf("unexpected error parsing command string: %s", err)
 				}
 				commandBreak = append(commandBreak, _break)
 				lexState = lexNone
@@ -293,8 +532,7 @@ func BreakCommandString(commandStr string) []string {
 			case '\'':
 				_break, err := unQuote(commandStr[lexStart : pos+1])
 				if err != nil {
-					trace("unexpected error parsing command string: %s", err)
-					os.Exit(0)
+					return nil, fmt.Errorf("unexpected error parsing command string: %s", err)
 				}
 				commandBreak = append(commandBreak, _break)
 				lexState = lexNone
@@ -316,82 +554,143 @@ func BreakCommandString(commandStr string) []string {
 	if lexState == lexName {
 		commandBreak = append(commandBreak, commandStr[lexStart:])
 	} else if lexState != lexNone {
-		trace("unexpected error command string: unclosed string literal")
-		os.Exit(0)
+		return nil, errors.New("unexpected error command string: unclosed string literal")
 	}
 
-	return commandBreak
+	return commandBreak, nil
 }
 
 // runCommands runs a list of commands, commandMap is a map of commandString and *command,
-// this function should be invoked with the first argument result of scanAndGetCommands
-// commandRoot is the map of all commands available is used when a command has continuation
-func runCommands(commandMap map[string]*command, commandRoot map[string]*command) {
-	for cmdString, cmd := range commandMap {
-		runCommand(cmdString, cmd, commandRoot)
-	}
-
-	var _commandMap map[string]*command
-	for _, _command := range commandMap {
-		if _command.Continue != "" {
-			if _commandMap == nil {
-				_commandMap = map[string]*command{}
-			}
-			if cmd, has := commandRoot[_command.Continue]; has {
-				_commandMap[cmd.Command] = cmd
-			}
-		}
-	}
-	if _commandMap != nil {
-		runCommands(_commandMap, commandRoot)
-	}
+// this function should be invoked with the first argument result of scanAndGetCommands,
+// the continuations and the dependents of the commands run after them
+func runCommands(commandMap map[string]*commandRun) {
+	runGraph(commandMap, devService.Concurrency, runCommand)
+}
+
+// responds reports if the command responds to op on path
+func (cmd *command) responds(path string, op eventOp) bool {
+	return cmd.events&op != 0 && devService.inScope(cmd, path) && cmd.matches(path)
 }
 
-func matchCommands(commandsRun map[string]*command, path string) {
+// matchCommands adds the commands responding to op that match path to commandsRun
+func matchCommands(commandsRun map[string]*commandRun, path string, op eventOp) {
 	for commandName, command := range commands {
-		if command.pattern != nil {
-			if command.pattern.MatchString(path) {
-				commandStr := command.pattern.ReplaceAllString(command.Command, path)
-				if _, found := commandsRun[commandStr]; !found {
-					commandsRun[commandStr] = command
-					debug("match command %s: %s", commandName, commandStr)
+		if command.responds(path, op) {
+			t := newTrigger(command, path, op)
+			// batch commands gather all the triggers in a single run and are expanded before running
+			commandStr := command.Command
+			if !command.Batch {
+				var err error
+				if commandStr, err = command.expandCommand(t); err != nil {
+					trace("err expanding command %s for %s: %s", commandName, path, err)
+					continue
 				}
 			}
+			if run, found := commandsRun[commandStr]; found {
+				run.addTrigger(t)
+			} else {
+				commandsRun[commandStr] = &commandRun{command: command, triggers: []*trigger{t}}
+				debug("match command %s: %s", commandName, commandStr)
+			}
 		}
 	}
 }
 
-func scanAndGetCommands(root string, commands map[string]*command) map[string]*command {
-	commandsRun := map[string]*command{}
-	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			trace("[warning] unexpected error walking file system path: %s|%s err: %s", root, path, err)
-		} else if !info.IsDir() {
-			matchCommands(commandsRun, path)
+// queueModification matches a modified path against the commands, matched commands
+// are queued in pendingCommands and will run on the next refresh
+func queueModification(path string, op eventOp) {
+	// the rules of a modified ignore file apply to the next events, even while paused
+	for _, file := range ignoreFiles {
+		if filepath.Base(path) == file {
+			devService.loadIgnoreFiles(filepath.Dir(path), true)
 		}
-		return nil
-	})
+	}
+
+	if atomic.LoadInt32(&watchPaused) == 1 {
+		debug("watching paused, ignoring event: %q", path)
+		return
+	}
+
+	info, err := os.Stat(path)
+	if devService.ignored(path, err == nil && info.IsDir()) {
+		debug("ignoring event: %q", path)
+		return
+	}
+
+	if commandName, found := producedBy(path); found {
+		debug("ignoring event: %q %s, output of %s", path, op, commandName)
+		return
+	}
+
+	debug("event: %q %s", path, op)
+	commandsRun := map[string]*commandRun{}
+	matchCommands(commandsRun, path, op)
+	queueCommands(commandsRun)
+
+	for _, command := range commands {
+		devService.reloadGoDeps(command, path)
+	}
+}
+
+// scanAndGetCommands walks the dirs and returns the commands matching the files found
+func scanAndGetCommands(dirs []string, commands map[string]*command) map[string]*commandRun {
+	commandsRun := map[string]*commandRun{}
+	for _, root := range dirs {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				trace("[warning] unexpected error walking file system path: %s|%s err: %s", root, path, err)
+			} else if devService.ignored(path, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+			} else if info.IsDir() {
+				devService.loadIgnoreFiles(path, false)
+			} else {
+				// the files found by the scan are handled as created and written
+				matchCommands(commandsRun, path, opCreate|opWrite)
+			}
+			return nil
+		})
+	}
 	return commandsRun
 }
 
 func (cmd *command) forceKillProcess(cmdString string) {
-	if command, ok := cmd.running[cmdString]; ok {
-		processKillWait(command)
-		delete(cmd.running, cmdString)
+	if process, ok := cmd.runningProcess(cmdString); ok {
+		cmd.stopProcess(process)
+		cmd.mx.Lock()
+		if cmd.running[cmdString] == process {
+			delete(cmd.running, cmdString)
+		}
+		cmd.mx.Unlock()
 	}
 }
 
-func processKillWait(command *exec.Cmd) {
-	if command.Process != nil {
-		command.Process.Kill()
-		command.Wait()
+// stopProcess sends the stop signal to the process group of process and waits for the process to exit,
+// when the process doesn't exit in stopTimeout the group is killed, the processes left in the group
+// after the process exits are killed as well
+func (cmd *command) stopProcess(process *process) {
+	cmd.mx.Lock()
+	process.stopping = true
+	cmd.mx.Unlock()
+
+	if err := signalProcessGroup(process.cmd, cmd.stopSignal); err != nil {
+		debug("err sending %s to %s: %s", cmd.stopSignal, cmd.name, err)
 	}
+
+	select {
+	case <-process.exited:
+	case <-time.After(cmd.stopTimeout):
+		trace("command %s did not stop in %s, killing it", cmd.name, cmd.stopTimeout)
+	}
+
+	killProcessGroup(process.cmd)
+	<-process.done
 }
 
 func (cmd *command) forceKillAllProcess() {
-	for cmdString, command := range cmd.running {
-		processKillWait(command)
-		delete(cmd.running, cmdString)
+	for _, cmdString := range cmd.runningCommands() {
+		cmd.forceKillProcess(cmdString)
 	}
 }
 
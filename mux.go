@@ -0,0 +1,274 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	colorsAuto   = "auto"
+	colorsAlways = "always"
+	colorsNever  = "never"
+
+	colorReset = "\x1b[0m"
+)
+
+// colorCodes are the colors of the color: option, the commands without color get a stable color of palette
+var (
+	colorCodes = map[string]string{
+		"red":     "\x1b[31m",
+		"green":   "\x1b[32m",
+		"yellow":  "\x1b[33m",
+		"blue":    "\x1b[34m",
+		"magenta": "\x1b[35m",
+		"cyan":    "\x1b[36m",
+		"white":   "\x1b[37m",
+		"gray":    "\x1b[90m",
+	}
+	palette = []string{"cyan", "green", "yellow", "blue", "magenta", "red"}
+)
+
+// muxMx serializes the lines written by the commands, lines of different processes don't interleave
+var muxMx sync.Mutex
+
+// prefixOption is the prefix: option of a command, false disables the prefix, true or
+// no prefix uses the name of the command
+type prefixOption struct {
+	text     string
+	disabled bool
+}
+
+func (p *prefixOption) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled bool
+	if err := unmarshal(&enabled); err == nil {
+		p.disabled = !enabled
+		return nil
+	}
+	return unmarshal(&p.text)
+}
+
+// isTerminal reports if f is a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// colorsEnabled reports if the lines written to f are colored with the colors: option
+func colorsEnabled(colors string, f *os.File) bool {
+	switch colors {
+	case colorsAlways:
+		return true
+	case colorsNever:
+		return false
+	}
+	return os.Getenv("NO_COLOR") == "" && isTerminal(f)
+}
+
+// stableColor returns the color of palette of the command name, the color doesn't change across runs
+func stableColor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return palette[h.Sum32()%uint32(len(palette))]
+}
+
+// lineWriter writes the output of a command line by line to out, each line is prefixed by the
+// prefix of the command and timestamped, the partial line is kept until it's completed or flushed,
+// the lines are also kept in the history and the log of the command
+type lineWriter struct {
+	cmd    *command
+	stream string
+	// out is the terminal the output is written to, nil when the output is only kept
+	out        io.Writer
+	prefix     string
+	color      string
+	timestamps bool
+
+	mx      sync.Mutex
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.writeLine(w.partial[:i])
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush writes the partial line, called when a process of the command exited
+func (w *lineWriter) flush() {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if len(w.partial) > 0 {
+		w.writeLine(w.partial)
+		w.partial = nil
+	}
+}
+
+func (w *lineWriter) writeLine(line []byte) {
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	if w.cmd.history != nil {
+		w.cmd.history.add(string(line))
+	}
+	if w.cmd.log != nil {
+		w.cmd.log.writeLine(w.stream, string(line))
+	}
+	if w.out == nil {
+		return
+	}
+
+	var b bytes.Buffer
+	if w.timestamps {
+		b.WriteString(time.Now().Format("15:04:05.000 "))
+	}
+	if w.prefix != "" {
+		b.WriteString(w.color)
+		b.WriteString(w.prefix)
+		b.WriteString(" |")
+		if w.color != "" {
+			b.WriteString(colorReset)
+		}
+		b.WriteByte(' ')
+	}
+	b.Write(line)
+	b.WriteByte('\n')
+
+	muxMx.Lock()
+	w.out.Write(b.Bytes())
+	muxMx.Unlock()
+}
+
+// initOutput creates the writers, the history and the log of the output of the commands,
+// the prefixes are padded to the longest prefix
+func (s *Service) initOutput() error {
+	switch s.Colors {
+	case "":
+		s.Colors = colorsAuto
+	case colorsAuto, colorsAlways, colorsNever:
+	default:
+		return fmt.Errorf("unknown colors %q, the colors are %s, %s and %s", s.Colors, colorsAuto, colorsAlways, colorsNever)
+	}
+	stdoutColors := colorsEnabled(s.Colors, os.Stdout)
+	stderrColors := colorsEnabled(s.Colors, os.Stderr)
+
+	prefixes := map[string]string{}
+	width := 0
+	for commandName, command := range s.Commands {
+		if command.Prefix.disabled {
+			continue
+		}
+		prefix := command.Prefix.text
+		if prefix == "" {
+			prefix = commandName
+		}
+		prefixes[commandName] = prefix
+		if len(prefix) > width {
+			width = len(prefix)
+		}
+	}
+
+	names := make([]string, 0, len(s.Commands))
+	for commandName := range s.Commands {
+		names = append(names, commandName)
+	}
+	sort.Strings(names)
+	for _, commandName := range names {
+		command := s.Commands[commandName]
+		color := command.Color
+		switch {
+		case color == "":
+			color = stableColor(commandName)
+		case color == "none":
+		case colorCodes[color] == "":
+			return fmt.Errorf("command %s: unknown color %q, the colors are %s", commandName, color, strings.Join(colorNames(), ", "))
+		}
+
+		prefix := prefixes[commandName]
+		if prefix != "" {
+			prefix = fmt.Sprintf("%-*s", width, prefix)
+		}
+		if command.History == 0 {
+			command.History = defaultHistory
+		}
+		if command.History > 0 {
+			command.history = newRingBuffer(command.History)
+		}
+
+		if command.Log != "" {
+			command.log = &rotatingFile{path: absPath(s.Dir, command.Log), maxSize: 10 << 20, maxFiles: command.LogMaxFiles}
+			if command.LogMaxSize != "" {
+				size, err := parseSize(command.LogMaxSize)
+				if err != nil {
+					return fmt.Errorf("command %s: %s", commandName, err)
+				}
+				command.log.maxSize = size
+			}
+			if command.LogMaxFiles == 0 {
+				command.log.maxFiles = 3
+			}
+		}
+
+		newWriter := func(stream string, enabled bool, out *os.File, colors bool) *lineWriter {
+			if !enabled && command.history == nil && command.log == nil {
+				return nil
+			}
+			w := &lineWriter{cmd: command, stream: stream, prefix: prefix, timestamps: s.Timestamps}
+			if enabled {
+				w.out = out
+			}
+			if colors {
+				w.color = colorCodes[color]
+			}
+			return w
+		}
+		command.stdout = newWriter("stdout", command.Stdout, os.Stdout, stdoutColors)
+		command.stderr = newWriter("stderr", command.Stderr, os.Stderr, stderrColors)
+	}
+	return nil
+}
+
+func colorNames() []string {
+	names := make([]string, 0, len(colorCodes))
+	for name := range colorCodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append(names, "none")
+}
+
+// flushOutput writes the partial lines of the command, called when a process of the command exited
+func (cmd *command) flushOutput() {
+	if cmd.stdout != nil {
+		cmd.stdout.flush()
+	}
+	if cmd.stderr != nil {
+		cmd.stderr.flush()
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	// outputsGrace is how long the outputs of a command are ignored after it stops
+	outputsGrace = time.Second
+	// loopWindow is the window a loop of a command re-triggering itself is detected
+	// in, commands in a loop don't respond to modifications during another window
+	loopWindow = 30 * time.Second
+	// maxLoopPaths is the number of paths of a run matched by the next run and reported when a loop is detected
+	maxLoopPaths = 10
+)
+
+// started marks the command as running a process
+func (cmd *command) started() {
+	cmd.mx.Lock()
+	cmd.active++
+	cmd.runs++
+	cmd.mx.Unlock()
+}
+
+// stopped marks the end of a process of the command
+func (cmd *command) stopped() {
+	cmd.mx.Lock()
+	if cmd.active > 0 {
+		cmd.active--
+	}
+	cmd.lastActive = time.Now()
+	cmd.mx.Unlock()
+}
+
+// producing reports if the command is running or stopped less than outputsGrace ago,
+// must be called with cmd.mx locked
+func (cmd *command) producing(now time.Time) bool {
+	return cmd.active > 0 || (!cmd.lastActive.IsZero() && now.Sub(cmd.lastActive) < outputsGrace)
+}
+
+// producedBy returns the name of the command that declares path as output and is
+// producing it, modifications of these paths are ignored
+func producedBy(path string) (string, bool) {
+	now := time.Now()
+	for commandName, command := range commands {
+		if command.outputs == nil || !command.outputs.match(path) {
+			continue
+		}
+		command.mx.Lock()
+		producing := command.producing(now)
+		command.mx.Unlock()
+		if producing {
+			return commandName, true
+		}
+	}
+	return "", false
+}
+
+// writes reports if path is declared as output of the command or is inside it's own dir
+func (cmd *command) writes(path string) bool {
+	if cmd.outputs != nil && cmd.outputs.match(path) {
+		return true
+	}
+	if cmd.ownDir == "" {
+		return false
+	}
+	_, inDir := within(cmd.ownDir, path)
+	return inDir
+}
+
+// retrigger records that path queued the command while it was producing, a run continues a loop
+// when it's re-triggered by a path the command writes, or for a command that waits by a path that
+// re-triggered every run of the loop, the files edited while the command runs don't continue it.
+// When more than loopLimit consecutive runs re-trigger the command in loopWindow the loop is broken
+// by suspending the command, the paths that caused the loop are reported
+func (cmd *command) retrigger(path string, now time.Time, loopLimit int) (suspended bool) {
+	cmd.mx.Lock()
+	defer cmd.mx.Unlock()
+
+	if now.Before(cmd.suspendedUntil) {
+		return true
+	}
+
+	if loopLimit <= 0 || !cmd.producing(now) {
+		return false
+	}
+
+	writes := cmd.writes(path)
+	if !writes && !cmd.Wait {
+		return false
+	}
+
+	if cmd.retriggeredRun == cmd.runs {
+		// the run already continues the loop, it's paths are matched by the next run
+		if writes || cmd.loopCount == 1 || containsString(cmd.loopPaths, path) {
+			cmd.runPaths = appendPath(cmd.runPaths, path)
+		}
+		return false
+	}
+
+	if cmd.retriggeredRun == cmd.runs-1 && now.Sub(cmd.loopStart) <= loopWindow {
+		if !writes && !containsString(cmd.runPaths, path) {
+			return false
+		}
+		cmd.loopPaths = cmd.runPaths
+		cmd.loopCount++
+	} else {
+		cmd.loopCount = 1
+		cmd.loopStart = now
+		cmd.loopPaths = nil
+	}
+	cmd.retriggeredRun = cmd.runs
+	cmd.runPaths = []string{path}
+
+	if cmd.loopCount > loopLimit {
+		trace("[warning] command %s re-triggered itself %d times in %s, it runs again in %s with the modifications queued meanwhile, paths: %s",
+			cmd.name, cmd.loopCount, roundDuration(now.Sub(cmd.loopStart), time.Millisecond), loopWindow, strings.Join(cmd.runPaths, ", "))
+		trace("[warning] declare the files written by %s in outputs: or ignore them", cmd.name)
+		cmd.suspendedUntil = now.Add(loopWindow)
+		cmd.loopCount = 0
+		cmd.loopStart = time.Time{}
+		return true
+	}
+	return false
+}
+
+// suspendedFor returns how long the command is still suspended, the runs queued meanwhile wait for the end
+func (cmd *command) suspendedFor(now time.Time) time.Duration {
+	cmd.mx.Lock()
+	defer cmd.mx.Unlock()
+	if left := cmd.suspendedUntil.Sub(now); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// appendPath appends path to the paths unless it's already there or the list is full
+func appendPath(paths []string, path string) []string {
+	if len(paths) < maxLoopPaths && !containsString(paths, path) {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// roundDuration rounds d to a multiple of m, used to print durations
+func roundDuration(d, m time.Duration) time.Duration {
+	return (d + m/2) / m * m
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetrigger(t *testing.T) {
+	const loopLimit = 5
+	now := time.Now()
+
+	// the app doesn't wait, it's restarted by the edits of the sources while it's running
+	app := &command{name: "app"}
+	app.started()
+	for i := 0; i < 10; i++ {
+		now = now.Add(3 * time.Second)
+		if app.retrigger(filepath.FromSlash("/project/main.go"), now, loopLimit) {
+			t.Fatalf("app suspended after %d edits", i+1)
+		}
+		app.stopped()
+		app.started()
+	}
+
+	// the server writes in it's own dir while running
+	server := &command{name: "server", ownDir: filepath.FromSlash("/project/server")}
+	server.started()
+	suspended := false
+	for i := 0; i <= loopLimit && !suspended; i++ {
+		now = now.Add(time.Second)
+		suspended = server.retrigger(filepath.FromSlash("/project/server/cache.json"), now, loopLimit)
+		server.stopped()
+		server.started()
+	}
+	if !suspended {
+		t.Error("server writing in it's dir not suspended")
+	}
+
+	// the build waits, the user edits a different file during each build
+	build := &command{name: "build", Wait: true}
+	for i := 0; i < 10; i++ {
+		build.started()
+		if build.retrigger(filepath.FromSlash(fmt.Sprintf("/project/file%d.go", i%3)), time.Now(), loopLimit) {
+			t.Fatalf("build suspended after %d edits", i+1)
+		}
+		build.stopped()
+	}
+
+	// the generator waits and writes the same file in every run, a user edit before it doesn't break the loop
+	generate := &command{name: "generate", Wait: true}
+	suspended = false
+	for i := 0; i <= loopLimit && !suspended; i++ {
+		generate.started()
+		generate.retrigger(filepath.FromSlash(fmt.Sprintf("/project/edit%d.go", i)), time.Now(), loopLimit)
+		suspended = generate.retrigger(filepath.FromSlash("/project/gen.go"), time.Now(), loopLimit)
+		generate.stopped()
+	}
+	if !suspended {
+		t.Error("generate loop not suspended")
+	}
+
+	// the modifications during the suspension are queued until it ends
+	now = time.Now()
+	if !generate.retrigger(filepath.FromSlash("/project/main.go"), now.Add(time.Second), loopLimit) {
+		t.Error("generate not suspended during the loop window")
+	}
+	if generate.ready(now.Add(time.Second)) || generate.ready(now.Add(loopWindow-time.Second)) {
+		t.Error("generate ready during the suspension")
+	}
+	if !generate.ready(now.Add(loopWindow + time.Second)) {
+		t.Error("generate not ready after the suspension")
+	}
+
+	// the generator is not re-triggered by edits after it stopped
+	generate = &command{name: "generate", Wait: true}
+	for i := 0; i < 10; i++ {
+		generate.started()
+		generate.stopped()
+		if generate.retrigger(filepath.FromSlash("/project/gen.go"), time.Now().Add(2*outputsGrace), loopLimit) {
+			t.Fatalf("generate suspended after %d edits", i+1)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	watcherNative = "native"
+	watcherPoll   = "poll"
+)
+
+// trackModifications starts the watcher configured in the service, when the native
+// watcher can't be started or can't register a path the polling watcher is used
+func trackModifications() {
+	if devService.Watcher == watcherPoll {
+		pollModifications()
+		return
+	}
+
+	if err := nativeTrackModifications(); err != nil {
+		trace("[warning] native modifications tracker failed: %s", err)
+		trace("[warning] falling back to polling watcher, checking for changes every %s", devService.PollInterval)
+		pollModifications()
+	}
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+}
+
+// snapshotTree collects the state of all files and directories under dirs that are not ignored
+func snapshotTree(dirs []string) map[string]fileState {
+	snapshot := map[string]fileState{}
+	for _, root := range dirs {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				debug("[warning] unexpected error walking file system path: %s|%s err: %s", root, path, err)
+			} else if devService.ignored(path, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+			} else {
+				if info.IsDir() {
+					devService.loadIgnoreFiles(path, false)
+				}
+				snapshot[path] = fileState{modTime: info.ModTime(), size: info.Size(), mode: info.Mode()}
+			}
+			return nil
+		})
+	}
+	return snapshot
+}
+
+// pollModifications detects modifications comparing snapshots of the file system taken every
+// PollInterval, it works where the native watcher gets no events, ex: network file systems
+func pollModifications() {
+	interval, err := time.ParseDuration(devService.PollInterval)
+	if err != nil || interval <= 0 {
+		trace("err parsing poll interval %q, using 1s: %s", devService.PollInterval, err)
+		interval = time.Second
+	}
+
+	trace("polling for modifications every %s", interval)
+	dirs := devService.GetWatchDirs()
+	snapshot := snapshotTree(dirs)
+	for range time.Tick(interval) {
+		// the files of the dirs added or dropped since the last snapshot were not created or removed
+		previous := dirs
+		dirs = devService.GetWatchDirs()
+		current := snapshotTree(dirs)
+		for path, state := range current {
+			if old, found := snapshot[path]; !found {
+				if withinAny(previous, path) {
+					queueModification(path, opCreate)
+				}
+			} else if !state.mode.IsDir() && (!old.modTime.Equal(state.modTime) || old.size != state.size) {
+				queueModification(path, opWrite)
+			} else if old.mode != state.mode {
+				queueModification(path, opChmod)
+			}
+		}
+		for path := range snapshot {
+			if _, found := current[path]; !found && withinAny(dirs, path) {
+				queueModification(path, opRemove)
+			}
+		}
+		snapshot = current
+	}
+}
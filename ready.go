@@ -0,0 +1,192 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readyInterval is the interval between the http and tcp probes
+const readyInterval = 100 * time.Millisecond
+
+// readyProbe is the ready: option of a command, the command is ready when all the probes passed
+type readyProbe struct {
+	// HTTP is an url, or a path of the app, ready when a GET returns 2xx
+	HTTP string `yaml:"http"`
+	// TCP is an address, or a :port of the app, ready when it accepts connections
+	TCP string `yaml:"tcp"`
+	// Stdout is a regex, ready when a line of the stdout of the command matches it
+	Stdout  string `yaml:"stdout"`
+	Timeout string `yaml:"timeout"`
+}
+
+// notReady are the commands started and not ready yet, the channels are closed
+// when the command is ready or the probe gave up, guarded by readyMx
+var (
+	readyMx  sync.Mutex
+	notReady = map[*command]chan struct{}{}
+)
+
+// readyProbed reports if a command of the service has ready probes
+func (s *Service) readyProbed() bool {
+	for _, command := range s.Commands {
+		if command.Ready != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// waitReady blocks until the started commands are ready, used to hold the proxied requests
+func waitReady() {
+	readyMx.Lock()
+	var pending []chan struct{}
+	for _, ready := range notReady {
+		pending = append(pending, ready)
+	}
+	readyMx.Unlock()
+	for _, ready := range pending {
+		<-ready
+	}
+}
+
+// lineMatcher is a writer that signals matched when a line written matches pattern
+type lineMatcher struct {
+	pw      *io.PipeWriter
+	matched chan struct{}
+}
+
+func newLineMatcher(pattern *regexp.Regexp) *lineMatcher {
+	pr, pw := io.Pipe()
+	m := &lineMatcher{pw: pw, matched: make(chan struct{})}
+	go func() {
+		scanner := bufio.NewScanner(pr)
+		found := false
+		for scanner.Scan() {
+			if !found && pattern.MatchString(scanner.Text()) {
+				found = true
+				close(m.matched)
+			}
+		}
+		// the output after the reader failed is discarded
+		io.Copy(ioutil.Discard, pr)
+	}()
+	return m
+}
+
+func (m *lineMatcher) Write(p []byte) (int, error) {
+	return m.pw.Write(p)
+}
+
+// Close ends the scan of the output, called when the process exited
+func (m *lineMatcher) Close() error {
+	return m.pw.Close()
+}
+
+// probeAddress completes the paths and ports of the probes with the address of the app
+func probeAddress(address string) string {
+	if strings.HasPrefix(address, ":") {
+		return "127.0.0.1" + address
+	}
+	return address
+}
+
+func probeURL(url string) string {
+	if strings.HasPrefix(url, "/") {
+		return "http://" + appHost + url
+	}
+	return url
+}
+
+// probeNet reports if the http and tcp probes of the command pass
+func (cmd *command) probeNet(client *http.Client) bool {
+	if cmd.Ready.TCP != "" {
+		conn, err := net.DialTimeout("tcp", probeAddress(cmd.Ready.TCP), readyInterval)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+	}
+	if cmd.Ready.HTTP != "" {
+		res, err := client.Get(probeURL(cmd.Ready.HTTP))
+		if err != nil {
+			return false
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return false
+		}
+	}
+	return true
+}
+
+// holdRequests marks the command as not ready, the proxied requests are held until ready is closed
+func (cmd *command) holdRequests() chan struct{} {
+	ready := make(chan struct{})
+	readyMx.Lock()
+	notReady[cmd] = ready
+	readyMx.Unlock()
+	return ready
+}
+
+// probeReady probes the process until it's ready, it exits, or readyTimeout, then ready is
+// closed, matched is closed when the stdout of the process matched
+func (cmd *command) probeReady(process *process, ready chan struct{}, matched <-chan struct{}) {
+	defer func() {
+		readyMx.Lock()
+		if notReady[cmd] == ready {
+			delete(notReady, cmd)
+		}
+		readyMx.Unlock()
+		close(ready)
+	}()
+
+	start := time.Now()
+	deadline := time.NewTimer(cmd.readyTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(readyInterval)
+	defer ticker.Stop()
+	client := &http.Client{Timeout: time.Second}
+
+	netReady := cmd.Ready.HTTP == "" && cmd.Ready.TCP == ""
+	for {
+		if netReady && matched == nil {
+			trace("command %s is ready in %s", cmd.name, roundDuration(time.Since(start), time.Millisecond))
+			cmd.runHooks(hookReady, nil)
+			return
+		}
+		select {
+		case <-matched:
+			matched = nil
+		case <-ticker.C:
+			if !netReady {
+				netReady = cmd.probeNet(client)
+			}
+		case <-process.exited:
+			trace("command %s exited before it was ready", cmd.name)
+			return
+		case <-deadline.C:
+			trace("[warning] command %s is not ready after %s, releasing the requests", cmd.name, cmd.readyTimeout)
+			return
+		}
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+)
+
+const (
+	// maxBackoff caps the delay between the restarts of a command
+	maxBackoff = 30 * time.Second
+	// stableRun is how long a process runs before it's not considered crashing, the
+	// count of consecutive restarts is reset when a process ran longer than stableRun
+	stableRun = 10 * time.Second
+)
+
+// restartPolicy is the restart: option of the commands that don't wait
+type restartPolicy string
+
+const (
+	restartNever     restartPolicy = "never"
+	restartOnFailure restartPolicy = "on-failure"
+	restartAlways    restartPolicy = "always"
+)
+
+func parseRestartPolicy(s string) (restartPolicy, error) {
+	switch policy := restartPolicy(s); policy {
+	case "":
+		return restartNever, nil
+	case restartNever, restartOnFailure, restartAlways:
+		return policy, nil
+	}
+	return restartNever, fmt.Errorf("unknown restart policy %q", s)
+}
+
+// process is a process of a command that doesn't wait, the process is waited by watchProcess
+type process struct {
+	cmd     *exec.Cmd
+	started time.Time
+	// restarts is the count of consecutive restarts of the command before this process
+	restarts int
+	// mark is the mark of the output of the process in the history of the command
+	mark int
+	// exited is closed when the process exited, done when the hooks run after it exited, err is the exit error
+	exited chan struct{}
+	done   chan struct{}
+	err    error
+	// stopping is set when devop stops the process, guarded by command.mx
+	stopping bool
+}
+
+// runningProcess returns the process of the command started with cmdString
+func (cmd *command) runningProcess(cmdString string) (*process, bool) {
+	cmd.mx.Lock()
+	defer cmd.mx.Unlock()
+	process, found := cmd.running[cmdString]
+	return process, found
+}
+
+// runningCommands returns the command strings of the processes of the command, the parallel
+// branches of a run of the graph start and stop the processes of the commands they share
+func (cmd *command) runningCommands() []string {
+	cmd.mx.Lock()
+	defer cmd.mx.Unlock()
+	cmdStrings := make([]string, 0, len(cmd.running))
+	for cmdString := range cmd.running {
+		cmdStrings = append(cmdStrings, cmdString)
+	}
+	return cmdStrings
+}
+
+// backoffDelay returns the delay before the attempt after attempt, the backoff is doubled on each attempt
+func (cmd *command) backoffDelay(attempt int) time.Duration {
+	delay := cmd.backoff
+	for i := 0; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// exitStatus describes the exit of a process
+func exitStatus(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
+
+// startProcess starts a process of a command that doesn't wait and stores it in running, must be called with runMutex locked
+func (cmd *command) startProcess(cmdString string, run *commandRun, restarts int) error {
+	if err := cmd.runHooks(hookBeforeRun, nil); err != nil {
+		return err
+	}
+
+	commandStr, proc, err := run.newProcess()
+	if err != nil {
+		return err
+	}
+
+	var matcher *lineMatcher
+	if cmd.readyPattern != nil {
+		matcher = newLineMatcher(cmd.readyPattern)
+		if proc.Stdout != nil {
+			proc.Stdout = io.MultiWriter(proc.Stdout, matcher)
+		} else {
+			proc.Stdout = matcher
+		}
+	}
+
+	trace("running command: %s", commandStr)
+	mark := cmd.outputMark()
+	cmd.started()
+	if err := proc.Start(); err != nil {
+		cmd.stopped()
+		trace("command %s failed to start: %s", cmd.name, err)
+		cmd.runHooks(hookFail, err)
+		return err
+	}
+
+	// the command will be stored and stopped in next match run
+	process := &process{cmd: proc, started: time.Now(), restarts: restarts, mark: mark, exited: make(chan struct{}), done: make(chan struct{})}
+	cmd.mx.Lock()
+	cmd.running[cmdString] = process
+	cmd.mx.Unlock()
+	if cmd.Ready != nil {
+		var matched chan struct{}
+		if matcher != nil {
+			matched = matcher.matched
+			go func() {
+				<-process.exited
+				matcher.Close()
+			}()
+		}
+		go cmd.probeReady(process, cmd.holdRequests(), matched)
+	}
+	go cmd.watchProcess(cmdString, run, process)
+	cmd.runHooks(hookStart, nil)
+	return nil
+}
+
+// watchProcess waits for the process to exit, processes that exit while not stopped by
+// devop are reported and restarted by the restart policy of the command
+func (cmd *command) watchProcess(cmdString string, run *commandRun, process *process) {
+	process.err = process.cmd.Wait()
+	detachStdin(process.cmd)
+	cmd.flushOutput()
+	cmd.stopped()
+	close(process.exited)
+
+	cmd.mx.Lock()
+	stopping := process.stopping
+	cmd.mx.Unlock()
+
+	cmd.runHooks(hookAfterRun, process.err)
+	if stopping {
+		cmd.runHooks(hookStop, process.err)
+		close(process.done)
+		return
+	}
+	if process.err != nil {
+		cmd.runHooks(hookFail, process.err)
+	}
+	close(process.done)
+
+	status := exitStatus(process.err)
+	if cmd.restart == restartNever || cmd.restart == restartOnFailure && process.err == nil {
+		trace("command %s exited: %s", cmd.name, status)
+		if process.err != nil {
+			cmd.reportOutput(process.mark)
+		}
+		return
+	}
+
+	restarts := process.restarts
+	if time.Since(process.started) >= stableRun {
+		restarts = 0
+	}
+	if cmd.MaxRestarts >= 0 && restarts >= cmd.MaxRestarts {
+		trace("[warning] command %s exited: %s, it crashed %d times in a row, not restarting it", cmd.name, status, restarts+1)
+		cmd.reportOutput(process.mark)
+		return
+	}
+
+	delay := cmd.backoffDelay(restarts)
+	if cmd.MaxRestarts >= 0 {
+		trace("command %s exited: %s, restarting in %s, attempt %d of %d", cmd.name, status, delay, restarts+1, cmd.MaxRestarts)
+	} else {
+		trace("command %s exited: %s, restarting in %s, attempt %d", cmd.name, status, delay, restarts+1)
+	}
+	if process.err != nil {
+		cmd.reportOutput(process.mark)
+	}
+	time.Sleep(delay)
+
+	runMutex.Lock()
+	defer runMutex.Unlock()
+	// the process was stopped or replaced while waiting
+	if current, _ := cmd.runningProcess(cmdString); current != process {
+		return
+	}
+	cmd.startProcess(cmdString, run, restarts+1)
+}
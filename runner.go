@@ -14,9 +14,77 @@
 
 package main
 
-import "os/exec"
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
 
-func newProcessCommand(commandStr string) *exec.Cmd {
-	command := BreakCommandString(commandStr)
-	return exec.Command(command[0], command[1:]...)
+// shellOption is the shell: option of a command, true selects the default shell of the system
+type shellOption string
+
+func (s *shellOption) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled bool
+	if err := unmarshal(&enabled); err == nil {
+		if enabled {
+			*s = defaultShell
+		} else {
+			*s = ""
+		}
+		return nil
+	}
+
+	var shell string
+	if err := unmarshal(&shell); err != nil {
+		return err
+	}
+	*s = shellOption(shell)
+	return nil
+}
+
+// quote quotes value for a command string run by the shell, without shell the value is
+// quoted to be split in a single argument
+func (s shellOption) quote(value string) string {
+	if s == "" {
+		return quoteArg(value)
+	}
+	return quoteShell(s, value)
+}
+
+// posixQuote quotes value with single quotes unless it's made of characters a posix shell
+// doesn't interpret, a single quote is closed, escaped and reopened
+func posixQuote(value string) string {
+	if plainString(value, "_-.,/:@%+=") {
+		return value
+	}
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// plainString reports if value is not empty and made of ascii letters, digits and the extra characters
+func plainString(value, extra string) bool {
+	if value == "" {
+		return false
+	}
+	for _, r := range value {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || strings.ContainsRune(extra, r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// newProcessCommand creates the process of commandStr, without shell the command string is
+// split in arguments and executed directly, otherwise it's executed by the shell
+func newProcessCommand(commandStr string, shell shellOption) (*exec.Cmd, error) {
+	if shell != "" {
+		return exec.Command(string(shell), shellArgs(shell, commandStr)...), nil
+	}
+	command, err := BreakCommandString(commandStr)
+	if err != nil {
+		return nil, err
+	}
+	if len(command) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return exec.Command(command[0], command[1:]...), nil
 }
@@ -0,0 +1,81 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// defaultShell is the shell used by the commands with shell: true
+const defaultShell = "sh"
+
+// shellArgs returns the arguments to run commandStr with shell
+func shellArgs(shell shellOption, commandStr string) []string {
+	return []string{"-c", commandStr}
+}
+
+// quoteShell quotes value for shell, the shells are handled as posix shells
+func quoteShell(shell shellOption, value string) string {
+	return posixQuote(value)
+}
+
+// historySignals print the output kept of the commands
+var historySignals = []os.Signal{syscall.SIGUSR1}
+
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// parseSignal parses a signal name, the SIG prefix is optional
+func parseSignal(name string) (os.Signal, error) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig, ok := signals[name]; ok {
+		return sig, nil
+	}
+	return nil, fmt.Errorf("unknown signal %q", name)
+}
+
+// setProcessGroup starts the process in a new process group, signals sent
+// to the group reach the processes started by the process
+func setProcessGroup(process *exec.Cmd) {
+	process.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalProcessGroup sends sig to the process group of process
+func signalProcessGroup(process *exec.Cmd, sig os.Signal) error {
+	if process.SysProcAttr != nil && process.SysProcAttr.Setpgid {
+		return syscall.Kill(-process.Process.Pid, sig.(syscall.Signal))
+	}
+	return process.Process.Signal(sig)
+}
+
+// killProcessGroup kills the process group of process
+func killProcessGroup(process *exec.Cmd) error {
+	return signalProcessGroup(process, syscall.SIGKILL)
+}
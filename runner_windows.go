@@ -0,0 +1,94 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// defaultShell is the shell used by the commands with shell: true
+const defaultShell = "cmd"
+
+// shellName returns the name of shell without extension, ex: cmd
+func shellName(shell shellOption) string {
+	return strings.TrimSuffix(strings.ToLower(filepath.Base(string(shell))), ".exe")
+}
+
+// shellArgs returns the arguments to run commandStr with shell, cmd and
+// powershell use their own flags, other shells are handled as posix shells
+func shellArgs(shell shellOption, commandStr string) []string {
+	switch shellName(shell) {
+	case "cmd":
+		return []string{"/C", commandStr}
+	case "powershell", "pwsh":
+		return []string{"-NoProfile", "-Command", commandStr}
+	}
+	return []string{"-c", commandStr}
+}
+
+// quoteShell quotes value for shell, cmd can't escape % inside double quotes so it's escaped
+// with ^ outside of them, windows paths can't contain double quotes, powershell doubles the
+// single quotes and the other shells are handled as posix shells
+func quoteShell(shell shellOption, value string) string {
+	switch shellName(shell) {
+	case "cmd":
+		if plainString(value, `_-.\/:`) {
+			return value
+		}
+		return `"` + strings.Replace(value, "%", `"^%"`, -1) + `"`
+	case "powershell", "pwsh":
+		if plainString(value, `_-.\/:`) {
+			return value
+		}
+		return "'" + strings.Replace(value, "'", "''", -1) + "'"
+	}
+	return posixQuote(value)
+}
+
+// historySignals print the output kept of the commands, windows has no signal for it
+var historySignals []os.Signal
+
+// parseSignal parses a signal name, windows can't deliver signals to other
+// processes so the processes are always killed
+func parseSignal(name string) (os.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "KILL", "TERM", "INT":
+		return os.Kill, nil
+	}
+	return nil, fmt.Errorf("unknown signal %q", name)
+}
+
+// setProcessGroup starts the process in a new process group
+func setProcessGroup(process *exec.Cmd) {
+	process.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// signalProcessGroup kills the process and the processes it started
+func signalProcessGroup(process *exec.Cmd, sig os.Signal) error {
+	return killProcessGroup(process)
+}
+
+// killProcessGroup kills the process tree of process with taskkill
+func killProcessGroup(process *exec.Cmd) error {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(process.Process.Pid)).Run(); err != nil {
+		return process.Process.Kill()
+	}
+	return nil
+}
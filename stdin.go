@@ -0,0 +1,89 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// escapeKey is ctrl-], typed before a key it runs the key instead of forwarding it to the stdin command
+const escapeKey = 0x1d
+
+// stdinCommand is the command with stdin: true, the input of devop is forwarded to it's current process
+var stdinCommand *command
+
+// stdinTarget is the stdin of the current process of stdinCommand, guarded by stdinMx
+var (
+	stdinMx      sync.Mutex
+	stdinProcess *exec.Cmd
+	stdinTarget  io.WriteCloser
+)
+
+// findStdinCommand returns the command with stdin: true, only one command can read the input of devop
+func (s *Service) findStdinCommand() (*command, error) {
+	var found []string
+	for _, name := range commandNames(s.Commands) {
+		if s.Commands[name].Stdin {
+			found = append(found, name)
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return nil, nil
+	case len(found) > 1:
+		return nil, fmt.Errorf("stdin is enabled in more than one command: %s", strings.Join(found, ", "))
+	case s.Commands[found[0]].Batch:
+		return nil, fmt.Errorf("command %s: stdin can't be used with batch, batches read the files from stdin", found[0])
+	}
+	return s.Commands[found[0]], nil
+}
+
+// attachStdin makes proc the process the input is forwarded to, called before proc starts
+func attachStdin(proc *exec.Cmd) error {
+	stdin, err := proc.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdinMx.Lock()
+	stdinProcess, stdinTarget = proc, stdin
+	stdinMx.Unlock()
+	return nil
+}
+
+// detachStdin stops forwarding the input to proc, called when proc exited
+func detachStdin(proc *exec.Cmd) {
+	stdinMx.Lock()
+	if stdinProcess == proc {
+		stdinProcess, stdinTarget = nil, nil
+	}
+	stdinMx.Unlock()
+}
+
+// forwardStdin writes the input to the current process of the stdin command, the input
+// typed while the command isn't running is discarded
+func forwardStdin(input []byte) {
+	stdinMx.Lock()
+	defer stdinMx.Unlock()
+	if stdinTarget == nil {
+		debug("command %s is not running, discarding the input", stdinCommand.name)
+		return
+	}
+	if _, err := stdinTarget.Write(input); err != nil {
+		debug("err forwarding the input to %s: %s", stdinCommand.name, err)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// trigger is a file modification that matched a command, the fields are available in the
+// templates of command, dir and env and are exported as DEVOP_ environment variables
+type trigger struct {
+	File    string
+	RelFile string
+	Dir     string
+	Name    string
+	Ext     string
+	Event   string
+
+	// Files and RelFiles are the files of all triggers of a batch command
+	Files    fileList
+	RelFiles fileList
+
+	groups []string
+}
+
+// fileList prints as a space separated list, the files are quoted when the command is expanded
+type fileList []string
+
+func (l fileList) String() string {
+	return strings.Join(l, " ")
+}
+
+// quoted returns the files quoted with quote
+func (l fileList) quoted(quote func(string) string) fileList {
+	if l == nil {
+		return nil
+	}
+	quoted := make(fileList, len(l))
+	for i, file := range l {
+		quoted[i] = quote(file)
+	}
+	return quoted
+}
+
+// quoteArg quotes s when it contains spaces or quotes, the command string splits it in a single argument
+func quoteArg(s string) string {
+	if strings.ContainsAny(s, " \t\"'\\") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// emptyTrigger is used for the commands that run as continuation or without modifications
+var emptyTrigger = &trigger{}
+
+func newTrigger(cmd *command, path string, op eventOp) *trigger {
+	t := &trigger{
+		File:    path,
+		RelFile: path,
+		Dir:     filepath.Dir(path),
+		Name:    filepath.Base(path),
+		Ext:     filepath.Ext(path),
+		Event:   op.String(),
+	}
+
+	for _, base := range cmd.bases {
+		if rel, ok := within(base, path); ok {
+			t.RelFile = filepath.FromSlash(rel)
+			break
+		}
+	}
+
+	if cmd.pattern != nil {
+		t.groups = cmd.pattern.FindStringSubmatch(path)
+	}
+	return t
+}
+
+// Match returns the capture group i of the match regex of the command, 0 is the whole match
+func (t *trigger) Match(i int) string {
+	if i < 0 || i >= len(t.groups) {
+		return ""
+	}
+	return t.groups[i]
+}
+
+// quoted returns a copy of the trigger which values are quoted with quote, used to expand the command
+func (t *trigger) quoted(quote func(string) string) *trigger {
+	q := *t
+	q.File = quote(t.File)
+	q.RelFile = quote(t.RelFile)
+	q.Dir = quote(t.Dir)
+	q.Name = quote(t.Name)
+	q.Ext = quote(t.Ext)
+	q.Files = t.Files.quoted(quote)
+	q.RelFiles = t.RelFiles.quoted(quote)
+	q.groups = make([]string, len(t.groups))
+	for i, group := range t.groups {
+		q.groups[i] = quote(group)
+	}
+	return &q
+}
+
+// env returns the DEVOP_ environment variables of the trigger
+func (t *trigger) env(cmd *command) []string {
+	env := []string{
+		"DEVOP_COMMAND=" + cmd.name,
+		"DEVOP_FILE=" + t.File,
+		"DEVOP_REL_FILE=" + t.RelFile,
+		"DEVOP_DIR=" + t.Dir,
+		"DEVOP_NAME=" + t.Name,
+		"DEVOP_EXT=" + t.Ext,
+		"DEVOP_EVENT=" + t.Event,
+	}
+	if t.Files != nil {
+		env = append(env,
+			"DEVOP_FILES="+strings.Join(t.Files, "\n"),
+			"DEVOP_REL_FILES="+strings.Join(t.RelFiles, "\n"),
+		)
+	}
+	return env
+}
+
+// parseTemplate parses text when it contains an action, nil is returned for plain text
+func parseTemplate(name, text string) (*template.Template, error) {
+	if !strings.Contains(text, "{{") {
+		return nil, nil
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template %q: %s", text, err)
+	}
+	return tmpl, nil
+}
+
+// execTemplate executes tmpl with the trigger, text is returned when tmpl is nil
+func execTemplate(tmpl *template.Template, text string, t *trigger) (string, error) {
+	if tmpl == nil {
+		return text, nil
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, t); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// commandRun is a command queued to run, triggers are the modifications that matched it
+type commandRun struct {
+	*command
+	triggers []*trigger
+}
+
+// addTrigger adds t to the triggers, replacing the trigger of the same file
+func (run *commandRun) addTrigger(t *trigger) {
+	for i, old := range run.triggers {
+		if old.File == t.File {
+			run.triggers[i] = t
+			return
+		}
+	}
+	run.triggers = append(run.triggers, t)
+}
+
+// lastTrigger returns the most recent trigger of the run
+func (run *commandRun) lastTrigger() *trigger {
+	if len(run.triggers) == 0 {
+		return emptyTrigger
+	}
+	return run.triggers[len(run.triggers)-1]
+}
+
+// batchTrigger returns the most recent trigger of the run with the files of all triggers
+func (run *commandRun) batchTrigger() *trigger {
+	t := *run.lastTrigger()
+	t.Files = make(fileList, 0, len(run.triggers))
+	t.RelFiles = make(fileList, 0, len(run.triggers))
+	for _, trigger := range run.triggers {
+		t.Files = append(t.Files, trigger.File)
+		t.RelFiles = append(t.RelFiles, trigger.RelFile)
+	}
+	return &t
+}
+
+// expandCommand executes the command template with the trigger, the values are quoted for the
+// shell of the command, without shell the values with spaces or quotes are quoted
+func (cmd *command) expandCommand(t *trigger) (string, error) {
+	return execTemplate(cmd.commandTemplate, cmd.Command, t.quoted(cmd.Shell.quote))
+}
+
+// expandDir executes the dir template with the trigger
+func (cmd *command) expandDir(t *trigger) (string, error) {
+	if cmd.dirTemplate == nil {
+		return cmd.Dir, nil
+	}
+	dir, err := execTemplate(cmd.dirTemplate, cmd.Dir, t)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(dir)
+}
+
+// expandEnv executes the env templates with the trigger and appends the DEVOP_ variables
+func (cmd *command) expandEnv(t *trigger) ([]string, error) {
+	env := make([]string, 0, len(cmd.Env)+7)
+	for i, v := range cmd.Env {
+		if tmpl, ok := cmd.envTemplates[i]; ok {
+			var err error
+			if v, err = execTemplate(tmpl, v, t); err != nil {
+				return nil, err
+			}
+		}
+		env = append(env, v)
+	}
+	return append(env, t.env(cmd)...), nil
+}
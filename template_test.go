@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"text/template"
+)
+
+func TestParseTemplate(t *testing.T) {
+	if tmpl, err := parseTemplate("plain", "go build ."); tmpl != nil || err != nil {
+		t.Errorf("parseTemplate(plain) = %v, %v, expected no template", tmpl, err)
+	}
+	if _, err := parseTemplate("unclosed", "echo {{.File"); err == nil {
+		t.Error("parseTemplate(unclosed) expected an error")
+	}
+}
+
+func TestExpandCommand(t *testing.T) {
+	cmd := &command{
+		name:    "test",
+		pattern: regexp.MustCompile(`(\w+)'s\.go$`),
+		bases:   []string{filepath.FromSlash("/project")},
+		Env:     []string{"MODE=dev", "FILE={{.RelFile}}"},
+	}
+	cmd.envTemplates = map[int]*template.Template{}
+	for i, v := range cmd.Env {
+		tmpl, err := parseTemplate(cmd.name, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tmpl != nil {
+			cmd.envTemplates[i] = tmpl
+		}
+	}
+
+	tests := []struct {
+		command string
+		path    string
+		args    []string
+	}{
+		{"echo {{.RelFile}}", "/project/main.go", []string{"echo", "main.go"}},
+		{"echo {{.RelFile}}", "/project/don't.go", []string{"echo", "don't.go"}},
+		{"echo {{.Name}} {{.Dir}}", "/project/my dir/a \"b\".go", []string{"echo", "a \"b\".go", filepath.FromSlash("/project/my dir")}},
+		{"echo {{.Match 1}}", "/project/devop's.go", []string{"echo", "devop"}},
+	}
+
+	for _, test := range tests {
+		cmd.Command = test.command
+		var err error
+		if cmd.commandTemplate, err = parseTemplate(cmd.name, cmd.Command); err != nil {
+			t.Fatal(err)
+		}
+		commandStr, err := cmd.expandCommand(newTrigger(cmd, filepath.FromSlash(test.path), opWrite))
+		if err != nil {
+			t.Errorf("expandCommand(%q, %q) failed: %s", test.command, test.path, err)
+			continue
+		}
+		if args, err := BreakCommandString(commandStr); err != nil || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("expandCommand(%q, %q) = %q, arguments %q %v, expected %q", test.command, test.path, commandStr, args, err, test.args)
+		}
+	}
+
+	env, err := cmd.expandEnv(newTrigger(cmd, filepath.FromSlash("/project/don't.go"), opWrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"MODE=dev", "FILE=don't.go", "DEVOP_COMMAND=test", "DEVOP_FILE=" + filepath.FromSlash("/project/don't.go")}
+	if !reflect.DeepEqual(env[:len(expected)], expected) {
+		t.Errorf("expandEnv = %q, expected %q", env, expected)
+	}
+}
+
+func TestExpandShellCommand(t *testing.T) {
+	cmd := &command{name: "test", Shell: "sh", Command: "printf '[%s]' {{.Name}} {{.Files}}"}
+	var err error
+	if cmd.commandTemplate, err = parseTemplate(cmd.name, cmd.Command); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"main.go", "x;cmd.go", "it's $(id).go", "a \"b\" `c`.go", "$HOME & *.go"}
+	run := &commandRun{command: cmd}
+	for _, name := range names {
+		run.addTrigger(newTrigger(cmd, filepath.Join("project", name), opWrite))
+	}
+	quoting := map[string]string{
+		"main.go":       "main.go",
+		"x;cmd.go":      "'x;cmd.go'",
+		"it's $(id).go": `'it'\''s $(id).go'`,
+		"":              "''",
+	}
+	for value, expected := range quoting {
+		if quoted := posixQuote(value); quoted != expected {
+			t.Errorf("posixQuote(%q) = %s, expected %s", value, quoted, expected)
+		}
+	}
+
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	// without a batch the list of files is empty
+	for i, name := range names {
+		commandStr, err := cmd.expandCommand(run.triggers[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		process, err := newProcessCommand(commandStr, cmd.Shell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, err := process.Output(); err != nil || string(out) != "["+name+"]" {
+			t.Errorf("%s printed %q, %v, expected [%s]", commandStr, out, err, name)
+		}
+	}
+
+	commandStr, err := cmd.expandCommand(run.batchTrigger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	process, err := newProcessCommand(commandStr, cmd.Shell)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[" + names[len(names)-1] + "]"
+	for _, name := range names {
+		expected += "[" + filepath.Join("project", name) + "]"
+	}
+	if out, err := process.Output(); err != nil || string(out) != expected {
+		t.Errorf("%s printed %q, %v, expected %s", commandStr, out, err, expected)
+	}
+}
+
+func TestBreakCommandString(t *testing.T) {
+	if args, err := BreakCommandString(`go build -o "my app" 'x'`); err != nil || !reflect.DeepEqual(args, []string{"go", "build", "-o", "my app", "x"}) {
+		t.Errorf("BreakCommandString = %q, %v", args, err)
+	}
+	if _, err := BreakCommandString(`echo "unclosed`); err == nil {
+		t.Error("BreakCommandString(unclosed) expected an error")
+	}
+}
@@ -17,31 +17,158 @@
 package main
 
 import (
-	"github.com/fsnotify/fsnotify"
+	"fmt"
+	"io/ioutil"
 	"os"
-	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
 )
 
-func trackModifications() {
+// nativeTrackModifications watches the tree with fsnotify, it returns an error when the
+// watcher can't be started or a directory can't be registered, ex: inotify watch limit reached
+func nativeTrackModifications() error {
 
 	fse, err := fsnotify.NewWatcher()
 	if err != nil {
-		trace("error starting modifications tracker: %s", err)
-		os.Exit(1)
+		return fmt.Errorf("error starting modifications tracker: %s", err)
 	}
 	defer fse.Close()
 
+	// fsnotify only watches a single directory level, every directory in the tree
+	// is registered and the set is kept in sync as directories come and go
+	watched := map[string]bool{}
+	for _, dir := range devService.GetWatchDirs() {
+		if err := watchTree(fse, watched, dir); err != nil {
+			return err
+		}
+	}
+
 	go func() {
-		for ev := range fse.Events {
-			debug("event: %q", ev.Name)
-			pendingMx.Lock()
-			matchCommands(pendingCommands, path.Join(root, ev.Name))
-			pendingMx.Unlock()
+		for err := range fse.Errors {
+			trace("[warning] modifications tracker error: %s", err)
 		}
 	}()
 
-	err = fse.Add(root)
+	for {
+		select {
+		case <-watchDirsChanged:
+			dirs := devService.GetWatchDirs()
+			for path := range watched {
+				if !withinAny(dirs, path) {
+					unwatchTree(fse, watched, path)
+				}
+			}
+			for _, dir := range dirs {
+				if err := watchTree(fse, watched, dir); err != nil {
+					return err
+				}
+			}
+		case ev, ok := <-fse.Events:
+			if !ok {
+				return nil
+			}
+
+			switch {
+			case ev.Op&fsnotify.Create == fsnotify.Create:
+				if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+					if err := watchTree(fse, watched, ev.Name); err != nil {
+						return err
+					}
+					// files can be created inside the new directory before the watch is registered
+					queueCommands(scanAndGetCommands([]string{ev.Name}, commands))
+				}
+			case ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+				if watched[ev.Name] {
+					unwatchTree(fse, watched, ev.Name)
+				}
+			}
+
+			queueModification(ev.Name, eventOpOf(ev.Op))
+		}
+	}
+}
+
+// eventOpOf translates fsnotify operations
+func eventOpOf(fsop fsnotify.Op) (op eventOp) {
+	if fsop&fsnotify.Create == fsnotify.Create {
+		op |= opCreate
+	}
+	if fsop&fsnotify.Write == fsnotify.Write {
+		op |= opWrite
+	}
+	if fsop&fsnotify.Remove == fsnotify.Remove {
+		op |= opRemove
+	}
+	if fsop&fsnotify.Rename == fsnotify.Rename {
+		op |= opRename
+	}
+	if fsop&fsnotify.Chmod == fsnotify.Chmod {
+		op |= opChmod
+	}
+	return
+}
+
+// watchTree registers dir and all it's subdirectories in the watcher, the watch is added
+// before the directory is listed so entries created meanwhile are not lost
+func watchTree(fse *fsnotify.Watcher, watched map[string]bool, dir string) error {
+	if devService.ignored(dir, true) {
+		return nil
+	}
+
+	if !watched[dir] {
+		if err := fse.Add(dir); err != nil {
+			// the directory can be removed, or replaced by a file, before it's registered
+			if missingDir(err) {
+				debug("skipping directory removed before it was watched: %s", dir)
+				return nil
+			}
+			return fmt.Errorf("error registering the watcher path %s: %s", dir, err)
+		}
+		watched[dir] = true
+		debug("watching directory: %s", dir)
+	}
+	devService.loadIgnoreFiles(dir, false)
+
+	files, err := ioutil.ReadDir(dir)
 	if err != nil {
-		trace("error registering the watcher path: %s", err)
+		// the directory can be removed before it's listed
+		trace("[warning] unexpected error walking file system path: %s err: %s", dir, err)
+		return nil
+	}
+
+	for _, info := range files {
+		if info.IsDir() {
+			if err := watchTree(fse, watched, filepath.Join(dir, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// missingDir reports if err is the error of a directory that doesn't exist or is not a directory
+func missingDir(err error) bool {
+	switch e := err.(type) {
+	case *os.SyscallError:
+		err = e.Err
+	case *os.PathError:
+		err = e.Err
+	}
+	return os.IsNotExist(err) || err == syscall.ENOTDIR
+}
+
+// unwatchTree drops the watches of dir and all it's subdirectories
+func unwatchTree(fse *fsnotify.Watcher, watched map[string]bool, dir string) {
+	prefix := dir + string(filepath.Separator)
+	for path := range watched {
+		if path == dir || strings.HasPrefix(path, prefix) {
+			// the watch can be already gone when the directory was deleted
+			fse.Remove(path)
+			delete(watched, path)
+			debug("stop watching directory: %s", path)
+		}
 	}
 }
@@ -14,14 +14,23 @@
 package main
 
 import (
+	"fmt"
 	"github.com/fsnotify/fsevents"
 	"time"
 )
 
-func trackModifications() {
+// nativeTrackModifications watches the trees with FSEvents, it returns an error
+// when the device of a watched dir can't be resolved
+func nativeTrackModifications() error {
+
+	for _, dir := range devService.GetWatchDirs() {
+		if _, err := fsevents.DeviceForPath(dir); err != nil {
+			return fmt.Errorf("error starting modifications tracker for %s: %s", dir, err)
+		}
+	}
 
 	fse := &fsevents.EventStream{
-		Paths:   []string{root},
+		Paths:   devService.GetWatchDirs(),
 		Latency: 500 * time.Millisecond,
 		// Device:  dev,
 		Flags: fsevents.FileEvents | fsevents.WatchRoot,
@@ -29,23 +38,41 @@ func trackModifications() {
 
 	fse.Start()
 
-	for ev := range fse.Events {
-		for _, event := range ev {
-			if event.Flags&fsevents.ItemIsFile == fsevents.ItemIsFile {
-				switch {
-				case event.Flags&fsevents.ItemCreated == fsevents.ItemCreated,
-					event.Flags&fsevents.ItemModified == fsevents.ItemModified,
-					event.Flags&fsevents.ItemRemoved == fsevents.ItemRemoved,
-					event.Flags&fsevents.ItemRenamed == fsevents.ItemRenamed:
-					debug("event: %q", event.Path)
-
-					pendingMx.Lock()
-					matchCommands(pendingCommands, event.Path)
-					pendingMx.Unlock()
-
+	for {
+		select {
+		case <-watchDirsChanged:
+			// the stream is restarted with the new dirs and resumes from the last event
+			fse.Paths = devService.GetWatchDirs()
+			fse.Restart()
+		case ev := <-fse.Events:
+			for _, event := range ev {
+				if event.Flags&fsevents.ItemIsFile == fsevents.ItemIsFile {
+					if op := eventOpOf(event.Flags); op != 0 {
+						queueModification(event.Path, op)
+					}
 				}
 			}
 		}
 	}
+}
 
+// eventOpOf translates FSEvents flags, FSEvents coalesces events so a single
+// event can carry more than one operation
+func eventOpOf(flags fsevents.EventFlags) (op eventOp) {
+	if flags&fsevents.ItemCreated == fsevents.ItemCreated {
+		op |= opCreate
+	}
+	if flags&fsevents.ItemModified == fsevents.ItemModified {
+		op |= opWrite
+	}
+	if flags&fsevents.ItemRemoved == fsevents.ItemRemoved {
+		op |= opRemove
+	}
+	if flags&fsevents.ItemRenamed == fsevents.ItemRenamed {
+		op |= opRename
+	}
+	if flags&(fsevents.ItemChangeOwner|fsevents.ItemInodeMetaMod) != 0 {
+		op |= opChmod
+	}
+	return
 }
@@ -0,0 +1,138 @@
+// Copyright 2016 José Santos <henrique_1609@me.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// watchRoot is a directory scanned and watched for modifications, the ignore files of the
+// directory and of it's subdirectories are applied to it's tree, the ignore rules of the
+// service are applied last
+type watchRoot struct {
+	dir    string
+	ignore ignoreList
+	rules  ignoreList
+
+	// mx guards ignore and nested, the ignore files are read while scanning and when they change
+	mx sync.Mutex
+	// nested are the rules of the ignore files of the subdirectories by slash separated
+	// relative dir, a dir without rules is stored once it's files were read
+	nested map[string]ignoreList
+}
+
+func newWatchRoot(dir string, rules []string) *watchRoot {
+	r := &watchRoot{dir: dir, nested: map[string]ignoreList{}}
+	r.ignore = rootRules(dir)
+	r.rules = ignoreList{}.appendLines(rules)
+	return r
+}
+
+// rootRules returns the rules of the ignore files of the root, .git is always ignored
+func rootRules(dir string) ignoreList {
+	return append(ignoreList{}.appendLines([]string{".git/"}), readIgnoreFiles(dir)...)
+}
+
+// loadIgnoreFiles reads the ignore files of dir when it's inside the root, the files of a dir
+// are read once unless reload is set
+func (r *watchRoot) loadIgnoreFiles(dir string, reload bool) {
+	rel, ok := within(r.dir, dir)
+	if !ok {
+		return
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if rel == "." {
+		if reload {
+			r.ignore = rootRules(dir)
+		}
+	} else if _, loaded := r.nested[rel]; !loaded || reload {
+		r.nested[rel] = readIgnoreFiles(dir)
+	}
+}
+
+// ignored reports if path or one of it's parent directories inside the root is ignored
+func (r *watchRoot) ignored(path string, isDir bool) bool {
+	rel, ok := within(r.dir, path)
+	if !ok || rel == "." {
+		return false
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for i := 0; i < len(rel); i++ {
+		if rel[i] == '/' && r.match(rel[:i], true) {
+			return true
+		}
+	}
+	return r.match(rel, isDir)
+}
+
+// match applies the rules of the root, then the rules of the ignore files of the dirs
+// containing rel from the outermost, relative to their dir, and the service rules last
+func (r *watchRoot) match(rel string, isDir bool) bool {
+	ignored := r.ignore.match(rel, isDir, false)
+	for i := 0; i < len(rel); i++ {
+		if rel[i] == '/' {
+			ignored = r.nested[rel[:i]].match(rel[i+1:], isDir, ignored)
+		}
+	}
+	return r.rules.match(rel, isDir, ignored)
+}
+
+// within returns the slash separated path of path relative to base, ok is false when
+// path is not inside base
+func within(base, path string) (rel string, ok bool) {
+	rel, err := filepath.Rel(base, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// withinAny reports if path is inside one of the dirs
+func withinAny(dirs []string, path string) bool {
+	for _, dir := range dirs {
+		if _, ok := within(dir, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// absPath resolves path relative to base
+func absPath(base, path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(base, path)
+}
+
+// collapseDirs removes the duplicated dirs and the dirs nested in other dirs of the list
+func collapseDirs(dirs []string) []string {
+	sorted := append([]string{}, dirs...)
+	sort.Strings(sorted)
+
+	var collapsed []string
+	for _, dir := range sorted {
+		if !withinAny(collapsed, dir) {
+			collapsed = append(collapsed, dir)
+		}
+	}
+	return collapsed
+}